@@ -0,0 +1,51 @@
+//go:build go1.18
+// +build go1.18
+
+package pretty
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzScanString(f *testing.F) {
+	for _, s := range []string{`"abc"`, `"\\\\\\""`, `"\u`, `"\u12"`, `"\"`,
+		`"a\\"b"`, `"\\\\\\\\"`, `"😀"`} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, src []byte) {
+		src = append([]byte{'"'}, src...)
+		end := scanString(src, 0)
+		// a quote ends the string when it follows an even number of
+		// backslashes
+		expect := len(src)
+		for i := 1; i < len(src); i++ {
+			if src[i] == '"' {
+				j := i - 1
+				for src[j] == '\\' {
+					j--
+				}
+				if (i-j)%2 == 1 {
+					expect = i + 1
+					break
+				}
+			}
+		}
+		if end != expect {
+			t.Fatalf("expected %d, got %d for %q", expect, end, src)
+		}
+		if valueEnd(src, 0) != end {
+			t.Fatalf("valueEnd: expected %d, got %d", end, valueEnd(src, 0))
+		}
+		if !bytes.HasPrefix(Ugly(src), src[:end]) {
+			t.Fatalf("ugly: %q", Ugly(src))
+		}
+		if !bytes.HasPrefix(Spec(src), src[:end]) {
+			t.Fatalf("spec: %q", Spec(src))
+		}
+		style := &Style{}
+		if _, n := appendColorString(nil, src, 0, false, style, styleAppend(style)); n != end {
+			t.Fatalf("color: expected %d, got %d", end, n)
+		}
+	})
+}
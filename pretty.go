@@ -2,9 +2,21 @@ package pretty
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
+	"math"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // Options is Pretty options
@@ -12,44 +24,800 @@ type Options struct {
 	// Width is an max column width for single line arrays
 	// Default is 80
 	Width int
-	// Prefix is a prefix for all lines
+	// WidthIgnoresIndent will fit the single line arrays and objects in the
+	// Width alone, rather than in the columns that remain after the
+	// indentation and key of their line, which packs deeply nested values
+	// the same as those at the top.
+	// Default is false
+	WidthIgnoresIndent bool
+	// NoPackedArraySpace will leave out the space that follows each comma
+	// of the arrays that are written on a single line, such as [1,2,3]
+	// rather than [1, 2, 3]. More elements fit in the Width, which counts
+	// the spaces.
+	// Default is false
+	NoPackedArraySpace bool
+	// Prefix is a prefix for all lines, including the first line
 	// Default is an empty string
 	Prefix string
 	// Indent is the nested indentation
 	// Default is two spaces
 	Indent string
+	// IndentObject and IndentArray, when set, are the indentation of the
+	// members of objects and arrays, in place of the Indent.
+	// Default is an empty string, which uses the Indent
+	IndentObject string
+	IndentArray  string
+	// BraceStyle is where the opening brace or bracket of an object or
+	// array that is the value of a key is written, such as BraceAllman for
+	// writing it on its own line, at the indentation of the key. Objects
+	// and arrays are never written on a single line with BraceAllman,
+	// except when they are empty.
+	// Default is BraceKAndR
+	BraceStyle BraceStyle
 	// SortKeys will sort the keys alphabetically
 	// Default is false
 	SortKeys bool
+	// SortBy is the order of the keys that are sorted by SortKeys, such as
+	// SortByValue for ordering the members by their values, and then by
+	// their keys. The values are ordered by type, like GroupByType, and then
+	// by value.
+	// Default is SortByKey
+	SortBy SortBy
+	// MaxBytes is the maximum size of the output. When the output would
+	// exceed this size, formatting stops, a "..." marker is added and all
+	// open objects and arrays are closed. The sorted members of objects are
+	// cut after sorting. When not even that fits, such as for a long
+	// string, the output is only the marker, or empty when MaxBytes is
+	// less than the marker. Zero means no limit.
+	// Default is 0
+	MaxBytes int
+	// SortKeysTopLevelOnly will sort the keys of the root object only,
+	// leaving the order of nested objects unchanged.
+	// Default is false
+	SortKeysTopLevelOnly bool
+	// OnToken is called for each key, value, object and array with the
+	// byte ranges of the token in the input and in the output. The calls
+	// are made in output order once formatting is complete.
+	// Default is nil
+	OnToken func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int)
+	// OmitFirstLinePrefix will not write the Prefix, or the BaseIndent, on
+	// the first line, which is useful when the output is appended to an
+	// existing line.
+	// Default is false
+	OmitFirstLinePrefix bool
+	// GroupDigits will insert thousands separators into the integer part of
+	// numbers, such as 1,000,000. The output is not valid JSON and is only
+	// intended for display.
+	// Default is false
+	GroupDigits bool
+	// PackLeafObjects will format objects that only contain strings,
+	// numbers, booleans and nulls on a single line, when the object fits
+	// within the Width. The length of a packed object does not depend on
+	// the order of its keys, so with SortKeys, sorting the keys before or
+	// after packing gives the same output, for any order of the input keys.
+	// Default is false
+	PackLeafObjects bool
+	// FillArrays will wrap arrays of strings, numbers, booleans and nulls
+	// that do not fit on a single line like text, with as many elements on
+	// each line as fit within the Width.
+	// Default is false
+	FillArrays bool
+	// ItemsPerLine, when greater than zero, is the maximum number of
+	// elements of an array on each line. Arrays of strings, numbers,
+	// booleans and nulls with more elements are wrapped like FillArrays,
+	// with at most ItemsPerLine elements on each line, such as for grids of
+	// numbers. Without a Width, such arrays are always written in rows.
+	// Default is 0
+	ItemsPerLine int
+	// PreserveComments will keep the // and /* */ comments of the input,
+	// such as from JSON5 documents. Comments between members are written
+	// on their own lines, prior to the member that follows them. Comments
+	// prior to a value are kept inline.
+	// Default is false
+	PreserveComments bool
+	// PreserveHeader will keep the comment lines at the start of the input,
+	// such as a #! shebang line or a // header, and write them unchanged
+	// above the output. The # lines are not removed by Spec, so they must be
+	// removed prior to parsing the output as JSON.
+	// Default is false
+	PreserveHeader bool
+	// TrimLineTrailingSpace will remove the spaces and tabs at the end of
+	// each line, such as those that precede a wrapped array element or a
+	// comment, so that editors and git hooks do not report them. Without
+	// it, the lines are written as they are formatted.
+	// Default is true
+	TrimLineTrailingSpace bool
+	// ChecksumComment will write a // sha256:<hex> comment after the output,
+	// such as for the provenance of generated config files. The checksum is
+	// of the canonical form of the document, with sorted keys and without
+	// whitespace or comments, and not of the output bytes, so it holds when
+	// the output is formatted again. See VerifyChecksum.
+	// Default is false
+	ChecksumComment bool
+	// MaxInlineArrayElements is the maximum number of elements for an array
+	// to be written on a single line. Arrays with more elements are always
+	// expanded, even when they fit within the Width. Zero means no limit.
+	// Default is 0
+	MaxInlineArrayElements int
+	// KeyCollator, when set, is used to compare keys when sorting. It must
+	// return a negative number when a < b, a positive number when a > b and
+	// zero when a == b. Such as the CompareString method of a
+	// golang.org/x/text/collate.Collator.
+	// Default is nil, which compares the bytes of the keys
+	KeyCollator func(a, b string) int
+	// TypeComments will add a comment with the type of each value, such as
+	// /* string */ or /* number */. Objects and arrays are labeled on the
+	// line of the opening bracket. The output is not valid JSON, but it can
+	// be converted back using Spec.
+	// Default is false
+	TypeComments bool
+	// NumberTypeSuffix will add a comment after each number with its type
+	// in the input, which is /* float */ for numbers with a fraction or an
+	// exponent, and for NaN and Inf, otherwise /* int */. The output is not
+	// valid JSON, but it can be converted back using Spec.
+	// Default is false
+	NumberTypeSuffix bool
+	// UppercaseKeys will uppercase the keys that are written by EnvStyle.
+	// Default is false
+	UppercaseKeys bool
+	// EscapeSlashes will escape the forward slashes in strings and keys as
+	// \/, such as for embedding the output in an HTML script element.
+	// Default is false
+	EscapeSlashes bool
+	// ReplaceInvalidUTF8 will replace the invalid UTF-8 bytes in strings and
+	// keys with the Unicode replacement character. See InvalidUTF8Strings.
+	// Default is false
+	ReplaceInvalidUTF8 bool
+	// PairColumns will align the second elements of arrays of pairs, such
+	// as [["name","Bob"],["age",42]], as a column, when the array does not
+	// fit on a single line, or always when there is no Width. The pairs
+	// must be arrays of two strings, numbers, booleans or nulls.
+	// Default is false
+	PairColumns bool
+	// TimeComments will add a comment with the UTC time to the values that
+	// look like times, such as /* Tue 2024-01-02 15:04:05 UTC */. These are
+	// strings in the RFC 3339 format, and integers with 10 digits (unix
+	// seconds) or 13 digits (unix milliseconds) that are from the years
+	// 2000 to 2099. The output is not valid JSON, but it can be converted
+	// back using Spec.
+	// Default is false
+	TimeComments bool
+	// GroupByType will order the keys of each object by the type of their
+	// values: nulls, false, numbers, strings, true, and then objects and
+	// arrays. The keys of each group keep their order, unless SortKeys is
+	// used.
+	// Default is false
+	GroupByType bool
+	// MaxKeyLength is the maximum number of characters of the keys that
+	// are written. Longer keys are cut and end with "...", which loses the
+	// rest of the key. The keys are still sorted by their full value. Zero
+	// means no limit.
+	// Default is 0
+	MaxKeyLength int
+	// CollapseLargeLeaves, when greater than zero, is the maximum number of
+	// bytes of the strings and numbers that are written. Larger values are
+	// replaced with a string of their size, such as "<8.2 KB>", which loses
+	// the value. Zero means no limit.
+	// Default is 0
+	CollapseLargeLeaves int
+	// BlankLineBetweenEntries will add a blank line between the members of
+	// the root object. Nested objects are not changed.
+	// Default is false
+	BlankLineBetweenEntries bool
+	// MaxConsecutiveBlankLines, when greater than zero, is the maximum number
+	// of blank lines in a row, such as from BlankLineBetweenEntries, a
+	// ValueFormatter, or the preserved comments. Longer runs are shortened.
+	// Default is 0
+	MaxConsecutiveBlankLines int
+	// TabWidth is the number of spaces written for each tab of the Indent
+	// and the Prefix, for output without tabs. Zero writes the tabs as is.
+	// Default is 0
+	TabWidth int
+	// RawPaths are the dotted paths of values that are written as is, with
+	// their original whitespace, such as "config.template" or "items.0",
+	// where array elements are named by their index. Keys that contain dots
+	// cannot be matched.
+	// Default is nil
+	RawPaths []string
+	// RenderEscapedNewlines will break strings after their \n escapes onto
+	// indented continuation lines, which end with a ↩ marker. The output is
+	// not valid JSON and is only intended for display.
+	// Default is false
+	RenderEscapedNewlines bool
+	// ExpandEmbeddedJSON will format the string values that contain an
+	// encoded JSON object or array as the nested document, instead of as an
+	// escaped string. The output is not the same document and is only
+	// intended for display. Only strings that are valid JSON are expanded,
+	// and the expanded documents are limited by MaxNestingDepth.
+	// Default is false
+	ExpandEmbeddedJSON bool
+	// SortArraysByKey, when set, will sort the arrays that only contain
+	// objects by the values of the key, such as "id". The values are
+	// ordered by type, like GroupByType, and then by value. Objects without
+	// the key go last.
+	// Default is ""
+	SortArraysByKey string
+	// FixLoneSurrogates will replace the \u escapes of lone UTF-16
+	// surrogates in strings and keys, which are not part of a valid
+	// surrogate pair, with \uFFFD, for consumers that reject them.
+	// Default is false
+	FixLoneSurrogates bool
+	// UnquoteSafeKeys will write the keys that are ECMAScript identifiers,
+	// such as name or _id, without quotes. Reserved words, such as class,
+	// and keys with other characters keep their quotes. The output is
+	// JSON5, which is not valid JSON.
+	// Default is false
+	UnquoteSafeKeys bool
+	// DisplayQuote is the quote of the strings and keys, such as ' for
+	// single quoted strings, where the quotes in the strings are escaped.
+	// Zero means a double quote. Other quotes are not valid JSON, and are
+	// only intended for display.
+	// Default is 0
+	DisplayQuote byte
+	// TreeGuides will draw the indentation of each member of an object or
+	// array with │ guides and ├─ or └─ connectors, like a tree, where └─
+	// is for the last member. The output is not valid JSON and is only
+	// intended for display.
+	// Default is false
+	TreeGuides bool
+	// ASCIIGuides will draw the TreeGuides with | guides and +- or `-
+	// connectors, for terminals and fonts without the box drawing
+	// characters.
+	// Default is false
+	ASCIIGuides bool
+	// NeverExpandScalarArrays will write the arrays that only contain
+	// strings, numbers, booleans and nulls on a single line, even when they
+	// do not fit within the Width. Arrays with more elements than
+	// MaxInlineArrayElements are still expanded.
+	// Default is false
+	NeverExpandScalarArrays bool
+	// CompactArraysOnly will always write the arrays on a single line and
+	// always expand the objects, no matter the Width, BreakFunc or
+	// PackLeafObjects. Arrays that contain objects are expanded, to keep
+	// their objects expanded.
+	// Default is false
+	CompactArraysOnly bool
+	// BreakFunc, when set, decides whether each object and array is
+	// expanded, by returning true, or written on a single line, in place of
+	// the Width. The depth is the number of objects and arrays that enclose
+	// it and the childCount is the number of its members. Objects and arrays
+	// that cannot be on a single line, such as objects that contain objects
+	// or arrays, are expanded. It is called once for each object and array,
+	// prior to formatting it, but not for the members of single line objects
+	// and arrays.
+	// Default is nil
+	BreakFunc func(depth int, kind TokenKind, childCount int) bool
+	// MaxObjectKeys is the maximum number of members of an object that are
+	// written, which are the first members in the order of the keys. The
+	// other members are replaced with a "… (3 more keys)" marker. The output
+	// is not valid JSON and is only intended for display. Zero means no
+	// limit.
+	// Default is 0
+	MaxObjectKeys int
+	// DedupKeys will keep only the last member of the keys that appear more
+	// than once in an object, like most parsers do, when the keys are sorted
+	// with SortKeys.
+	// Default is false
+	DedupKeys bool
+	// ValueFormatter, when set, is called for each string, number, boolean
+	// and null value with its dotted path, like RawPaths, its bytes and its
+	// kind. When it returns true, the returned bytes are written in place of
+	// the value. Returning bytes that are not JSON makes the output not valid
+	// JSON.
+	// Default is nil
+	ValueFormatter func(path string, raw []byte, t TokenKind) ([]byte, bool)
+	// PointerGutter will add a comment with the JSON Pointer of the value
+	// to each line that has a value, such as /* /users/0/name */. Objects
+	// and arrays that are expanded are labeled on the line of the opening
+	// bracket. The root value is not labeled. The output is not valid JSON,
+	// but it can be converted back using Spec.
+	// Default is false
+	PointerGutter bool
+	// AnchorComments will add a comment with the JSON Pointer of the value
+	// to the end of each line that starts a member or closes an object or
+	// array, such as /* /users/0/name */. The lines keep their anchors
+	// when values change, which helps to align the lines of two outputs.
+	// The root value is not labeled. The output is not valid JSON, but it
+	// can be converted back using Spec, or formatted again, which drops
+	// the comments unless PreserveComments is used.
+	// Default is false
+	AnchorComments bool
+	// BracketMatchComments will add a comment to the line of each closing
+	// bracket of the expanded objects and arrays, with the key or index
+	// that opened it, such as /* user */ or /* tags[3] */. The root value
+	// and the objects and arrays on a single line are not labeled. With
+	// AnchorComments, the lines keep their anchors. The output is not valid
+	// JSON, but it can be converted back using Spec, or formatted again,
+	// like AnchorComments.
+	// Default is false
+	BracketMatchComments bool
+	// NumberNotation is the notation that numbers are converted to, such as
+	// NotationDecimal for 10000000000 or NotationScientific for 1e+10. The
+	// numbers are converted through a float64, which keeps at most 17
+	// significant digits. Integers beyond the precision of a float64, and
+	// numbers that a float64 cannot hold, are written as is.
+	// Default is NotationPreserve
+	NumberNotation NumberNotation
+	// NormalizeSigns will remove the + sign of numbers, such as +5 to 5,
+	// the - sign of zeros, such as -0 to 0 and -0.0e5 to 0.0e5, and the
+	// leading zeros of the integer part, such as 007 to 7 and -00.5 to
+	// -0.5. The fraction and exponent are left as is, and NaN and Inf are
+	// not changed.
+	// Default is false
+	NormalizeSigns bool
+	// HardWrap, when greater than zero, is the maximum width of the lines.
+	// Wider lines, such as those of long strings, are broken and continued
+	// on the next line with one more indent. Lines are not broken inside
+	// of an escape or a character, and the widths are the DisplayWidth of
+	// the lines, with a tab of TabWidth columns, or 8 when it is not set.
+	// The output is only intended for display and is not valid JSON.
+	// Default is 0
+	HardWrap int
+	// MaxDepth is the maximum depth of the objects and arrays that are
+	// written, where the root is at a depth of 1. Deeper objects and arrays
+	// are replaced with the number of their members, such as { 12 keys } or
+	// [ 3 elements ]. The output is not valid JSON and is only intended for
+	// display. Zero means no limit.
+	// Default is 0
+	MaxDepth int
+	// MaxNestingDepth is the maximum depth of the objects and arrays that
+	// are formatted, which protects the stack when formatting untrusted
+	// documents that are nested very deeply. Deeper objects and arrays are
+	// replaced with the number of their members, like MaxDepth. Zero means
+	// the default limit of 10000, which is raised by using a larger value.
+	// A negative value means no limit.
+	// Default is 0
+	MaxNestingDepth int
+	// BaseIndent is the number of extra Indent levels for all lines.
+	// Default is 0
+	BaseIndent int
+	// DecodeUTF16 will transcode input that starts with a UTF-16 byte order
+	// mark to UTF-8 prior to formatting. See DecodeToUTF8.
+	// Default is false
+	DecodeUTF16 bool
+	// ArraysAsObjects will write arrays as objects that are keyed by the
+	// index of each element, such that [10,20] becomes {"0": 10, "1": 20}.
+	// This changes the meaning of the document, and is only for tools that
+	// cannot read arrays. The source offsets of OnToken are offsets into
+	// the input, where the keys are at the offsets of their elements.
+	// Default is false
+	ArraysAsObjects bool
+	// ArrayNullMode is how the null elements of arrays are written, such as
+	// NullDrop for removing them. The null values of objects are not
+	// changed. Like ArraysAsObjects, the source offsets of OnToken are
+	// offsets into the input, where the "" of NullEmpty are at the offsets
+	// of their nulls.
+	// Default is NullKeep
+	ArrayNullMode ArrayNullMode
+	// Colorize will colorize the output with the style while formatting,
+	// which is like calling Color on the output without the second pass.
+	// Default is nil
+	Colorize *Style
 }
 
+// TokenKind is the kind of a formatted token
+type TokenKind int
+
+const (
+	TokenKey TokenKind = iota
+	TokenString
+	TokenNumber
+	TokenTrue
+	TokenFalse
+	TokenNull
+	TokenObject
+	TokenArray
+)
+
+// NumberNotation is the notation of numbers for Options.NumberNotation
+type NumberNotation int
+
+const (
+	// NotationPreserve writes numbers as is
+	NotationPreserve NumberNotation = iota
+	// NotationDecimal writes numbers without exponents, such as 0.00001
+	NotationDecimal
+	// NotationScientific writes numbers with exponents, such as 1e-05
+	NotationScientific
+)
+
+// SortBy is the order of the sorted keys for Options.SortBy
+type SortBy int
+
+const (
+	// SortByKey orders the members by their keys, and then by their values
+	SortByKey SortBy = iota
+	// SortByValue orders the members by their values, and then by their
+	// keys
+	SortByValue
+)
+
+// BraceStyle is where the opening braces and brackets are written for
+// Options.BraceStyle
+type BraceStyle int
+
+const (
+	// BraceKAndR writes the opening brace after the key, on the same line
+	BraceKAndR BraceStyle = iota
+	// BraceAllman writes the opening brace on its own line, below the key
+	BraceAllman
+)
+
+// ArrayNullMode is how null array elements are written for
+// Options.ArrayNullMode
+type ArrayNullMode int
+
+const (
+	// NullKeep writes null elements as is
+	NullKeep ArrayNullMode = iota
+	// NullEmpty writes null elements as empty strings
+	NullEmpty
+	// NullDrop removes null elements
+	NullDrop
+)
+
 // DefaultOptions is the default options for pretty formats.
-var DefaultOptions = &Options{Width: 80, Prefix: "", Indent: "  ", SortKeys: false}
+var DefaultOptions = &Options{Width: 80, Prefix: "", Indent: "  ", SortKeys: false,
+	TrimLineTrailingSpace: true}
+
+// CompactOptions returns options for dense output that is still easy to
+// read, such as for logs. Leaf objects are packed on a single line and
+// arrays of scalars are filled like text, up to a Width of 100 with an
+// Indent of two spaces.
+func CompactOptions() *Options {
+	return &Options{Width: 100, Indent: "  ", PackLeafObjects: true,
+		FillArrays: true, TrimLineTrailingSpace: true}
+}
+
+// ReadableOptions returns options for reading by people, such as for
+// documentation. Arrays are on a single line up to a Width of 80, with an
+// Indent of four spaces.
+func ReadableOptions() *Options {
+	return &Options{Width: 80, Indent: "    ", TrimLineTrailingSpace: true}
+}
+
+// DiffOptions returns options for output that is compared line by line,
+// such as by diff tools and version control. The keys are sorted and every
+// element of an object or array is on its own line, by using a Width of 0,
+// with an Indent of two spaces. Lines end with a single LF.
+func DiffOptions() *Options {
+	return &Options{Width: 0, Indent: "  ", SortKeys: true,
+		TrimLineTrailingSpace: true}
+}
 
 // Pretty converts the input json into a more human readable format where each
-// element is on it's own line with clear indentation.
+// element is on it's own line with clear indentation. Input that is empty or
+// only has whitespace results in empty output, like Ugly, Color and Spec.
 func Pretty(json []byte) []byte { return PrettyOptions(json, nil) }
 
+// PrettyAuto is like Pretty but uses the number of columns of the terminal as
+// the Width, or 80 when the output is not a terminal.
+func PrettyAuto(json []byte) []byte {
+	opts := *DefaultOptions
+	opts.Width = terminalWidth()
+	if opts.Width <= 0 {
+		opts.Width = 80
+	}
+	return PrettyOptions(json, &opts)
+}
+
 // PrettyOptions is like Pretty but with customized options.
 func PrettyOptions(json []byte, opts *Options) []byte {
 	if opts == nil {
 		opts = DefaultOptions
 	}
-	buf := make([]byte, 0, len(json))
-	if len(opts.Prefix) != 0 {
-		buf = append(buf, opts.Prefix...)
+	return prettyOptions(json, &prettyState{opts: opts})
+}
+
+// PrettySafe is like PrettyOptions but returns an error instead of
+// panicking, such as for servers that format untrusted documents. Panics of
+// the callbacks of the options, like OnToken, are returned too.
+func PrettySafe(json []byte, opts *Options) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg := "unknown error"
+			switch v := r.(type) {
+			case error:
+				msg = v.Error()
+			case string:
+				msg = v
+			}
+			out, err = nil, errors.New("panic while formatting: "+msg)
+		}
+	}()
+	return PrettyOptions(json, opts), nil
+}
+
+// Mapping is the position of a token in the output of PrettyWithSourceMap
+// and in its input. The Length is the number of bytes of the token in the
+// output, which is not the same as in the input when the token is changed
+// by the options, such as a number with NumberNotation.
+type Mapping struct {
+	OutStart, InStart, Length int
+}
+
+// PrettyWithSourceMap is like PrettyOptions but also returns the mappings
+// of the output positions of the keys, values and brackets to their input
+// positions, in output order. The mappings follow the keys that are moved
+// by SortKeys. The OnToken of the options is still called, and Colorize is
+// not used, which keeps the positions of the output the same as the json.
+func PrettyWithSourceMap(json []byte, opts *Options) (out []byte, srcMap []Mapping) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	mopts := *opts
+	mopts.Colorize = nil
+	type bracket struct{ src, dst int }
+	var closes []bracket
+	mopts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+		if opts.OnToken != nil {
+			opts.OnToken(kind, srcStart, srcEnd, dstStart, dstEnd)
+		}
+		if kind == TokenObject || kind == TokenArray {
+			srcMap = append(srcMap, Mapping{dstStart, srcStart, 1})
+			if srcEnd-1 > srcStart && dstEnd-1 > dstStart {
+				closes = append(closes, bracket{srcEnd - 1, dstEnd - 1})
+			}
+			return
+		}
+		srcMap = append(srcMap, Mapping{dstStart, srcStart, dstEnd - dstStart})
+	}
+	out = PrettyOptions(json, &mopts)
+	for _, c := range closes {
+		// the closing brackets of the objects and arrays that were closed
+		if c.src < len(json) && c.dst < len(out) &&
+			(json[c.src] == '}' || json[c.src] == ']') &&
+			(out[c.dst] == '}' || out[c.dst] == ']') {
+			srcMap = append(srcMap, Mapping{c.dst, c.src, 1})
+		}
+	}
+	sort.SliceStable(srcMap, func(i, j int) bool {
+		return srcMap[i].OutStart < srcMap[j].OutStart
+	})
+	return out, srcMap
+}
+
+// PrettyOptionsMapped is like PrettyWithSourceMap but only returns the input
+// offset of the first key, value or bracket of each line of the output, such
+// as for finding the input of a line that another parser rejected. Lines
+// without one, like comment lines, are -1.
+func PrettyOptionsMapped(json []byte, opts *Options) (out []byte, lines []int) {
+	out, srcMap := PrettyWithSourceMap(json, opts)
+	lines = append(lines, -1)
+	var pos int
+	for _, m := range srcMap {
+		for ; pos < m.OutStart && pos < len(out); pos++ {
+			if out[pos] == '\n' && pos+1 < len(out) {
+				lines = append(lines, -1)
+			}
+		}
+		if lines[len(lines)-1] == -1 {
+			lines[len(lines)-1] = m.InStart
+		}
+	}
+	for ; pos < len(out); pos++ {
+		if out[pos] == '\n' && pos+1 < len(out) {
+			lines = append(lines, -1)
+		}
+	}
+	return out, lines
+}
+
+// PrettyMarshal returns the pretty json encoding of v, which is encoded
+// with encoding/json and then formatted with the options. The keys of maps
+// are sorted by the encoder, like SortKeys, while the fields of structs keep
+// their order unless SortKeys is used. The characters <, > and & are only
+// escaped, for embedding in HTML, when EscapeSlashes is used.
+func PrettyMarshal(v interface{}, opts *Options) ([]byte, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(opts.EscapeSlashes)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return PrettyOptions(data.Bytes(), opts), nil
+}
+
+// PrettyPrefix is like PrettyOptions but stops formatting once the output
+// reaches maxLines lines, such as for displaying the first screen of a large
+// document. The output is cut at the end of a line, leaving the open
+// objects and arrays unclosed. The consumed return value is the offset of
+// the first input byte that was not formatted, or len(json) when the whole
+// document was formatted.
+//
+// The formatter does not keep state between calls. Unless keys are sorted,
+// the output is the start of the PrettyOptions output, so more lines can be
+// rendered by calling PrettyPrefix again with a larger maxLines.
+func PrettyPrefix(json []byte, maxLines int, opts *Options) (out []byte, consumed int) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	st := &prettyState{opts: opts, maxLines: maxLines}
+	out = prettyOptions(json, st)
+	return out, st.consumed
+}
+
+// PrettyLen returns the length of the PrettyOptions output, such as for
+// deciding whether to render a document. The finished lines of each object
+// and array are counted and dropped while formatting, so the output is not
+// kept. The options that rewrite the finished output, such as SortKeys,
+// MaxBytes, HardWrap and TreeGuides, still need the whole output.
+func PrettyLen(json []byte, opts *Options) int {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	st := &prettyState{opts: opts, count: countable(opts)}
+	buf := prettyOptions(json, st)
+	return st.flushed + len(buf)
+}
+
+// countable returns true when the finished lines of the output can be
+// dropped by PrettyLen, which is when no option rewrites them.
+func countable(opts *Options) bool {
+	return !opts.SortKeys && !opts.SortKeysTopLevelOnly && !opts.GroupByType &&
+		opts.SortArraysByKey == "" && opts.MaxBytes <= 0 && opts.HardWrap <= 0 &&
+		opts.MaxConsecutiveBlankLines <= 0 && opts.OnToken == nil &&
+		!opts.TreeGuides && !opts.AnchorComments && !opts.BracketMatchComments
+}
+
+// GoStringLiteral is like PrettyOptions but the output is written as a Go
+// string literal, such as for pasting test fixtures into Go source. When raw
+// is true, the output is a `raw` string literal, unless it contains a
+// backtick or a carriage return, which cannot be in raw literals. Otherwise
+// the output is a double-quoted literal with escapes.
+func GoStringLiteral(json []byte, opts *Options, raw bool) []byte {
+	out := PrettyOptions(json, opts)
+	if raw && bytes.IndexByte(out, '`') == -1 && bytes.IndexByte(out, '\r') == -1 {
+		lit := make([]byte, 0, len(out)+2)
+		lit = append(lit, '`')
+		lit = append(lit, out...)
+		return append(lit, '`')
+	}
+	return strconv.AppendQuote(nil, string(out))
+}
+
+// PrettyOrderedLike is like PrettyOptions but the keys of each object are
+// ordered to match their first appearance in the template document. Keys
+// that are not in the template go last, alphabetically.
+func PrettyOrderedLike(json, template []byte, opts *Options) []byte {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	order := make(map[string]int)
+	walkJSON(template, func(kind TokenKind, start, end, depth int) {
+		if kind == TokenKey {
+			key := string(parsestr(template[start:end]))
+			if _, ok := order[key]; !ok {
+				order[key] = len(order)
+			}
+		}
+	})
+	return prettyOptions(json, &prettyState{opts: opts, order: order})
+}
+
+func prettyOptions(json []byte, st *prettyState) []byte {
+	if st.opts.TabWidth > 0 && strings.ContainsRune(st.opts.Prefix+
+		st.opts.Indent+st.opts.IndentObject+st.opts.IndentArray, '\t') {
+		spaces := strings.Repeat(" ", st.opts.TabWidth)
+		opts := *st.opts
+		opts.Prefix = strings.ReplaceAll(opts.Prefix, "\t", spaces)
+		opts.Indent = strings.ReplaceAll(opts.Indent, "\t", spaces)
+		opts.IndentObject = strings.ReplaceAll(opts.IndentObject, "\t", spaces)
+		opts.IndentArray = strings.ReplaceAll(opts.IndentArray, "\t", spaces)
+		st.opts = &opts
+	}
+	opts := st.opts
+	if opts.DecodeUTF16 {
+		if utf8json, err := DecodeToUTF8(json); err == nil {
+			json = utf8json
+		}
+	}
+	var buf []byte
+	if !st.count {
+		buf = make([]byte, 0, len(json))
+	}
+	var start int
+	if opts.PreserveHeader {
+		start = headerEnd(json)
+		buf = append(buf, json[:start]...)
+	}
+	if isBlank(json[start:]) {
+		// no value, and no prefix
+		st.consumed = len(json)
+		return buf
+	}
+	if opts.ArrayNullMode != NullKeep {
+		conv, spans := arrayNulls(json[start:], opts.ArrayNullMode)
+		json = append(json[:start:start], conv...)
+		st.addConv(spans, start)
+	}
+	if opts.ArraysAsObjects {
+		conv, spans := arraysToObjects(json[start:])
+		json = append(json[:start:start], conv...)
+		st.addConv(spans, start)
 	}
-	buf, _, _, _ = appendPrettyAny(buf, json, 0, true,
-		opts.Width, opts.Prefix, opts.Indent, opts.SortKeys,
-		0, 0, -1)
-	if len(buf) > 0 && bytes.Contains(buf, []byte{'\n'}) {
+	if !opts.OmitFirstLinePrefix {
+		buf = appendTabs(buf, opts.Prefix, opts.Indent, opts.BaseIndent)
+	}
+	if opts.BaseIndent > 0 {
+		st.base = opts.BaseIndent
+	}
+	if opts.Colorize != nil {
+		st.style = opts.Colorize
+		st.apnd = styleAppend(st.style)
+	}
+	if opts.IndentObject != "" || opts.IndentArray != "" {
+		st.kinds = make([]byte, 0, 8)
+	}
+	if len(opts.RawPaths) > 0 {
+		st.raw = make(map[string]bool, len(opts.RawPaths))
+		for _, path := range opts.RawPaths {
+			st.raw[path] = true
+		}
+	}
+	if opts.MaxBytes > 0 {
+		// reserve room for the trailing newline
+		st.reserve = 1
+	}
+	var i int
+	buf, i, _, _ = appendPrettyAny(buf, json, start, true, st, st.base, 0, -1)
+	if st.opts.MaxConsecutiveBlankLines > 0 {
+		buf = st.collapseBlankLines(buf)
+	}
+	if st.opts.AnchorComments || st.opts.BracketMatchComments {
+		buf = st.drawAnchors(buf)
+	}
+	if st.opts.TreeGuides {
+		buf = st.drawGuides(buf)
+	}
+	if st.stopped {
+		buf, _ = st.appendNewline(buf)
+		if st.opts.HardWrap > 0 {
+			buf = st.hardWrap(buf)
+		}
+		buf = st.fitBytes(buf)
+		st.consumed, _ = st.inputRange(st.consumed, st.consumed)
+		st.emitTokens()
+		return buf
+	}
+	st.consumed, _ = st.inputRange(len(json), len(json))
+	if opts.PreserveComments && !st.truncated {
+		// comments that follow the root value
+		for ; i < len(json); i++ {
+			if isComment(json, i) {
+				end := commentEnd(json, i)
+				buf, _ = st.appendNewline(buf)
+				buf = appendTabs(buf, opts.Prefix, opts.Indent, st.base)
+				buf = appendComment(buf, json[i:end])
+				i = end - 1
+			}
+		}
+	}
+	if st.flushed > 0 || len(buf) > 0 && bytes.Contains(buf, []byte{'\n'}) {
+		buf, _ = st.appendNewline(buf)
+	}
+	if st.opts.HardWrap > 0 {
+		buf = st.hardWrap(buf)
+	}
+	if opts.ChecksumComment && !st.truncated {
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			buf, _ = st.appendNewline(buf)
+		}
+		buf = appendTabs(buf, opts.Prefix, opts.Indent, st.base)
+		buf = appendChecksum(buf, json[start:])
 		buf = append(buf, '\n')
 	}
+	buf = st.fitBytes(buf)
+	st.emitTokens()
 	return buf
 }
 
 // Ugly removes insignificant space characters from the input json byte slice
-// and returns the compacted result.
+// and returns the compacted result, which is empty for input that only has
+// whitespace.
 func Ugly(json []byte) []byte {
 	buf := make([]byte, 0, len(json))
 	return ugly(buf, json)
@@ -67,616 +835,5198 @@ func ugly(dst, src []byte) []byte {
 		if src[i] > ' ' {
 			dst = append(dst, src[i])
 			if src[i] == '"' {
-				for i = i + 1; i < len(src); i++ {
-					dst = append(dst, src[i])
-					if src[i] == '"' {
-						j := i - 1
-						for ; ; j-- {
-							if src[j] != '\\' {
-								break
-							}
-						}
-						if (j-i)%2 != 0 {
-							break
-						}
-					}
-				}
+				end := scanString(src, i)
+				dst = append(dst, src[i+1:end]...)
+				i = end - 1
 			}
 		}
 	}
 	return dst
 }
 
-func isNaNOrInf(src []byte) bool {
-	return src[0] == 'i' || //Inf
-		src[0] == 'I' || // inf
-		src[0] == '+' || // +Inf
-		src[0] == 'N' || // Nan
-		(src[0] == 'n' && len(src) > 1 && src[1] != 'u') // nan
-}
-
-func appendPrettyAny(buf, json []byte, i int, pretty bool, width int, prefix, indent string, sortkeys bool, tabs, nl, max int) ([]byte, int, int, bool) {
-	for ; i < len(json); i++ {
+// Compact removes insignificant space characters from the input json like
+// Ugly, but keeps a space after each comma and colon, such as
+// {"a": 1, "b": [1, 2]}. The result is a single line.
+func Compact(json []byte) []byte {
+	buf := make([]byte, 0, len(json))
+	for i := 0; i < len(json); i++ {
 		if json[i] <= ' ' {
 			continue
 		}
 		if json[i] == '"' {
-			return appendPrettyString(buf, json, i, nl)
-		}
-
-		if (json[i] >= '0' && json[i] <= '9') || json[i] == '-' || isNaNOrInf(json[i:]) {
-			return appendPrettyNumber(buf, json, i, nl)
-		}
-		if json[i] == '{' {
-			return appendPrettyObject(buf, json, i, '{', '}', pretty, width, prefix, indent, sortkeys, tabs, nl, max)
-		}
-		if json[i] == '[' {
-			return appendPrettyObject(buf, json, i, '[', ']', pretty, width, prefix, indent, sortkeys, tabs, nl, max)
+			end := valueEnd(json, i)
+			buf = append(buf, json[i:end]...)
+			i = end - 1
+			continue
 		}
-		switch json[i] {
-		case 't':
-			return append(buf, 't', 'r', 'u', 'e'), i + 4, nl, true
-		case 'f':
-			return append(buf, 'f', 'a', 'l', 's', 'e'), i + 5, nl, true
-		case 'n':
-			return append(buf, 'n', 'u', 'l', 'l'), i + 4, nl, true
+		buf = append(buf, json[i])
+		if json[i] == ',' || json[i] == ':' {
+			buf = append(buf, ' ')
 		}
 	}
-	return buf, i, nl, true
+	return buf
 }
 
-type pair struct {
-	kstart, kend int
-	vstart, vend int
+func isNaNOrInf(src []byte) bool {
+	return src[0] == 'i' || //Inf
+		src[0] == 'I' || // inf
+		src[0] == '+' || // +Inf
+		src[0] == 'N' || // Nan
+		(src[0] == 'n' && len(src) > 1 && src[1] != 'u') // nan
 }
 
-type byKeyVal struct {
-	sorted bool
-	json   []byte
-	buf    []byte
-	pairs  []pair
+// prettyState is the state of a single PrettyOptions call.
+type prettyState struct {
+	opts *Options
+	// count is true when the finished lines are dropped by flush, for
+	// PrettyLen, and flushed is the number of dropped bytes.
+	count   bool
+	flushed int
+	// reserve is the number of bytes needed to close all open containers
+	// when MaxBytes is used.
+	reserve   int
+	truncated bool
+	// tokens are the collected tokens when OnToken is used.
+	tokens []token
+	// order is the key order used by PrettyOrderedLike.
+	order map[string]int
+	// maxLines is the maximum number of lines for PrettyPrefix. The
+	// lineCount is the number of newlines in the buffer up to lineMark.
+	maxLines  int
+	lineCount int
+	lineMark  int
+	stopped   bool
+	allman    bool // the next object or array is the value of a key
+	consumed  int
+	// convs are the spans of the conversions of the input, in the order
+	// they were done, for mapping the source offsets back to the input.
+	convs [][]srcSpan
+	// base is the indentation level of the root value.
+	base int
+	// kinds are the brackets of the open objects and arrays at each level,
+	// when Options.IndentObject or Options.IndentArray is used.
+	kinds []byte
+	// raw are the Options.RawPaths, and path is the dotted path of the
+	// current value when they are used.
+	raw  map[string]bool
+	path []byte
+	// pointer is the JSON Pointer of the current value when
+	// Options.PointerGutter or Options.AnchorComments is used, and anchors
+	// are the pointers of the tokenAnchor tokens.
+	pointer []byte
+	anchors []string
+	// match is the label of the current value when
+	// Options.BracketMatchComments is used, which is the key of the value,
+	// or of the closest member of an object, followed by the indexes of the
+	// arrays, and matchKey is the start of the key.
+	match    []byte
+	matchKey int
+	// style and apnd are used for Options.Colorize.
+	style *Style
+	apnd  func(dst []byte, c byte) []byte
 }
 
-func (arr *byKeyVal) Len() int {
-	return len(arr.pairs)
-}
-func (arr *byKeyVal) Less(i, j int) bool {
-	if arr.isLess(i, j, byKey) {
-		return true
-	}
-	if arr.isLess(j, i, byKey) {
-		return false
-	}
-	return arr.isLess(i, j, byVal)
-}
-func (arr *byKeyVal) Swap(i, j int) {
-	arr.pairs[i], arr.pairs[j] = arr.pairs[j], arr.pairs[i]
-	arr.sorted = true
+type token struct {
+	kind             TokenKind
+	srcStart, srcEnd int
+	dstStart, dstEnd int
 }
 
-type byKind int
+// tokenLine is the kind of the tokens at the start of the lines of members,
+// which are collected for Options.TreeGuides and are not emitted.
+const tokenLine TokenKind = -1
 
-const (
-	byKey byKind = 0
-	byVal byKind = 1
-)
+// tokenAnchor is the kind of the tokens for the lines that are given a
+// comment by Options.AnchorComments or Options.BracketMatchComments. The
+// srcStart is the index of the comment in the anchors.
+const tokenAnchor TokenKind = -2
 
-type jtype int
+// addToken adds a token and returns its index, or -1 when tokens are not
+// being collected.
+func (st *prettyState) addToken(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) int {
+	if st.opts.OnToken == nil && !st.opts.TreeGuides && !st.opts.AnchorComments &&
+		!st.opts.BracketMatchComments {
+		return -1
+	}
+	st.tokens = append(st.tokens, token{kind, srcStart, srcEnd, dstStart, dstEnd})
+	return len(st.tokens) - 1
+}
 
-const (
-	jnull jtype = iota
-	jfalse
-	jnumber
-	jstring
-	jtrue
-	jjson
-)
+// addLine adds a token for the line of a member that starts at dst, for
+// Options.TreeGuides. The tokens are moved along with their members.
+func (st *prettyState) addLine(src, dst int) {
+	if st.opts.TreeGuides {
+		st.addToken(tokenLine, src, src, dst, dst)
+	}
+}
 
-func getjtype(v []byte) jtype {
-	if len(v) == 0 {
-		return jnull
+// addAnchor adds a token for the line that starts at dst, for
+// Options.AnchorComments. The line is given the pointer of the current
+// value, or of its element n when n is not -1.
+func (st *prettyState) addAnchor(dst, n int) {
+	if !st.opts.AnchorComments {
+		return
 	}
-	switch v[0] {
-	case '"':
-		return jstring
-	case 'f':
-		return jfalse
-	case 't':
-		return jtrue
-	case 'n':
-		return jnull
-	case '[', '{':
-		return jjson
-	default:
-		return jnumber
+	pointer := st.pointer
+	if n != -1 {
+		pointer = appendPointer(pointer, nil, n)
 	}
+	if len(pointer) == 0 {
+		// the root value is not labeled
+		return
+	}
+	st.anchors = append(st.anchors, string(pointer))
+	k := len(st.anchors) - 1
+	st.addToken(tokenAnchor, k, k, dst, dst)
 }
 
-func (arr *byKeyVal) isLess(i, j int, kind byKind) bool {
-	k1 := arr.json[arr.pairs[i].kstart:arr.pairs[i].kend]
-	k2 := arr.json[arr.pairs[j].kstart:arr.pairs[j].kend]
-	var v1, v2 []byte
-	if kind == byKey {
-		v1 = k1
-		v2 = k2
-	} else {
-		v1 = bytes.TrimSpace(arr.buf[arr.pairs[i].vstart:arr.pairs[i].vend])
-		v2 = bytes.TrimSpace(arr.buf[arr.pairs[j].vstart:arr.pairs[j].vend])
-		if len(v1) >= len(k1)+1 {
-			v1 = bytes.TrimSpace(v1[len(k1)+1:])
-		}
-		if len(v2) >= len(k2)+1 {
-			v2 = bytes.TrimSpace(v2[len(k2)+1:])
-		}
+// addMatch adds a token for the line of a closing bracket that starts at
+// dst, for Options.BracketMatchComments. The line is given the label of the
+// current value.
+func (st *prettyState) addMatch(dst int) {
+	if !st.opts.BracketMatchComments || len(st.match) == 0 {
+		// the root value is not labeled
+		return
 	}
-	t1 := getjtype(v1)
-	t2 := getjtype(v2)
-	if t1 < t2 {
-		return true
+	st.anchors = append(st.anchors, string(st.match[st.matchKey:]))
+	k := len(st.anchors) - 1
+	st.addToken(tokenAnchor, k, k, dst, dst)
+}
+
+func (st *prettyState) emitTokens() {
+	if st.opts.OnToken == nil {
+		return
 	}
-	if t1 > t2 {
-		return false
+	sort.SliceStable(st.tokens, func(i, j int) bool {
+		return st.tokens[i].dstStart < st.tokens[j].dstStart
+	})
+	for _, t := range st.tokens {
+		if t.kind >= 0 {
+			srcStart, srcEnd := st.inputRange(t.srcStart, t.srcEnd)
+			st.opts.OnToken(t.kind, srcStart, srcEnd, t.dstStart, t.dstEnd)
+		}
 	}
-	if t1 == jstring {
-		s1 := parsestr(v1)
-		s2 := parsestr(v2)
-		return string(s1) < string(s2)
-	}
-	if t1 == jnumber {
-		n1, _ := strconv.ParseFloat(string(v1), 64)
-		n2, _ := strconv.ParseFloat(string(v2), 64)
-		return n1 < n2
-	}
-	return string(v1) < string(v2)
+}
 
+// guideLine is a line of the output for Options.TreeGuides. The depth is
+// the number of indents past the BaseIndent, or -1 for lines that are not
+// changed. The next is true for members that are followed by a sibling.
+type guideLine struct {
+	start, end, depth int
+	member, next      bool
 }
 
-func parsestr(s []byte) []byte {
-	for i := 1; i < len(s); i++ {
-		if s[i] == '\\' {
-			var str string
-			json.Unmarshal(s, &str)
-			return []byte(str)
-		}
-		if s[i] == '"' {
-			return s[1:i]
+// drawGuides replaces the indentation of the lines with the guides of
+// Options.TreeGuides, and moves the tokens to match.
+func (st *prettyState) drawGuides(buf []byte) []byte {
+	prefix, indent := st.opts.Prefix, st.opts.Indent
+	if indent == "" {
+		return buf
+	}
+	members := make(map[int]bool)
+	for _, t := range st.tokens {
+		if t.kind == tokenLine {
+			members[t.dstStart] = true
 		}
 	}
-	return nil
-}
-
-func appendPrettyObject(buf, json []byte, i int, open, close byte, pretty bool, width int, prefix, indent string, sortkeys bool, tabs, nl, max int) ([]byte, int, int, bool) {
-	var ok bool
-	if width > 0 {
-		if pretty && open == '[' && max == -1 {
-			// here we try to create a single line array
-			max := width - (len(buf) - nl)
-			if max > 3 {
-				s1, s2 := len(buf), i
-				buf, i, _, ok = appendPrettyObject(buf, json, i, '[', ']', false, width, prefix, "", sortkeys, 0, 0, max)
-				if ok && len(buf)-s1 <= max {
-					return buf, i, nl, true
-				}
-				buf = buf[:s1]
-				i = s2
+	var lines []guideLine
+	for start := 0; start <= len(buf); {
+		end := bytes.IndexByte(buf[start:], '\n')
+		if end == -1 {
+			end = len(buf)
+		} else {
+			end += start
+		}
+		l := guideLine{start: start, end: end, depth: -1, member: members[start]}
+		if end > start && strings.HasPrefix(string(buf[start:end]), prefix) {
+			j, n := start+len(prefix), 0
+			for ; bytes.HasPrefix(buf[j:end], []byte(indent)); j += len(indent) {
+				n++
 			}
-		} else if max != -1 && open == '{' {
-			return buf, i, nl, false
+			l.depth = n - st.base
 		}
+		lines = append(lines, l)
+		start = end + 1
 	}
-	buf = append(buf, open)
-	i++
-	var pairs []pair
-	if open == '{' && sortkeys {
-		pairs = make([]pair, 0, 8)
-	}
-	var n int
-	for ; i < len(json); i++ {
-		if json[i] <= ' ' {
+	// a member is followed by a sibling when a member of the same depth
+	// comes first, prior to a line of a lower depth
+	var seen []bool
+	for i := len(lines) - 1; i >= 0; i-- {
+		l := &lines[i]
+		if l.depth < 0 {
 			continue
 		}
-		if json[i] == close {
-			if pretty {
-				if open == '{' && sortkeys {
-					buf = sortPairs(json, buf, pairs)
-				}
-				if n > 0 {
-					nl = len(buf)
-					if buf[nl-1] == ' ' {
-						buf[nl-1] = '\n'
-					} else {
-						buf = append(buf, '\n')
-					}
-				}
-				if buf[len(buf)-1] != open {
-					buf = appendTabs(buf, prefix, indent, tabs)
-				}
-			}
-			buf = append(buf, close)
-			return buf, i + 1, nl, open != '{'
+		for len(seen) <= l.depth {
+			seen = append(seen, false)
 		}
-		if open == '[' || json[i] == '"' {
-			if n > 0 {
-				buf = append(buf, ',')
-				if width != -1 && open == '[' {
-					buf = append(buf, ' ')
-				}
+		if l.member {
+			l.next = seen[l.depth]
+			seen[l.depth] = true
+		}
+		for k := l.depth + 1; k < len(seen); k++ {
+			seen[k] = false
+		}
+	}
+	w := len(indent)
+	guide := func(dst []byte, c string, fill string) []byte {
+		dst = append(dst, c...)
+		for k := 1; k < w; k++ {
+			if k < w-1 || w == 2 {
+				dst = append(dst, fill...)
+			} else {
+				dst = append(dst, ' ')
 			}
-			var p pair
-			if pretty {
-				nl = len(buf)
-				if buf[nl-1] == ' ' {
-					buf[nl-1] = '\n'
-				} else {
-					buf = append(buf, '\n')
-				}
-				if open == '{' && sortkeys {
-					p.kstart = i
-					p.vstart = len(buf)
-				}
-				buf = appendTabs(buf, prefix, indent, tabs+1)
+		}
+		return dst
+	}
+	glyphs := [3]string{"├", "└", "│"}
+	fill := "─"
+	if st.opts.ASCIIGuides {
+		glyphs = [3]string{"+", "`", "|"}
+		fill = "-"
+	}
+	// next is the next value of the member that contains the line, at each
+	// depth
+	var next []bool
+	nbuf := make([]byte, 0, len(buf)+len(buf)/2)
+	shifts := make([]int, len(lines))
+	for i, l := range lines {
+		if l.depth <= 0 {
+			nbuf = append(nbuf, buf[l.start:l.end]...)
+		} else {
+			for len(next) <= l.depth {
+				next = append(next, false)
 			}
-			if open == '{' {
-				buf, i, nl, _ = appendPrettyString(buf, json, i, nl)
-				if sortkeys {
-					p.kend = i
-				}
-				buf = append(buf, ':')
-				if pretty {
-					buf = append(buf, ' ')
+			if l.member {
+				next[l.depth] = l.next
+				for k := l.depth + 1; k < len(next); k++ {
+					next[k] = false
 				}
 			}
-			buf, i, nl, ok = appendPrettyAny(buf, json, i, pretty, width, prefix, indent, sortkeys, tabs+1, nl, max)
-			if max != -1 && !ok {
-				return buf, i, nl, false
-			}
-			if pretty && open == '{' && sortkeys {
-				p.vend = len(buf)
-				if p.kstart > p.kend || p.vstart > p.vend {
-					// bad data. disable sorting
-					sortkeys = false
-				} else {
-					pairs = append(pairs, p)
+			j := l.start + len(prefix) + w*st.base
+			nbuf = append(nbuf, buf[l.start:j]...)
+			for k := 1; k <= l.depth; k++ {
+				switch {
+				case l.member && k == l.depth && l.next:
+					nbuf = guide(nbuf, glyphs[0], fill)
+				case l.member && k == l.depth:
+					nbuf = guide(nbuf, glyphs[1], fill)
+				case next[k]:
+					nbuf = guide(nbuf, glyphs[2], " ")
+				default:
+					nbuf = append(nbuf, indent...)
 				}
 			}
-			i--
-			n++
+			nbuf = append(nbuf, buf[j+w*l.depth:l.end]...)
+		}
+		shifts[i] = len(nbuf) - l.end
+		if l.end < len(buf) {
+			nbuf = append(nbuf, '\n')
 		}
 	}
-	return buf, i, nl, open != '{'
+	ends := make([]int, len(lines))
+	for i, l := range lines {
+		ends[i] = l.end
+	}
+	st.moveTokens(ends, shifts)
+	return nbuf
 }
-func sortPairs(json, buf []byte, pairs []pair) []byte {
-	if len(pairs) == 0 {
-		return buf
+
+// drawAnchors appends the comments of Options.AnchorComments and
+// Options.BracketMatchComments to the ends of the lines that have an anchor,
+// and moves the tokens to match. A line only has its first comment.
+func (st *prettyState) drawAnchors(buf []byte) []byte {
+	anchors := make(map[int]string)
+	for _, t := range st.tokens {
+		if t.kind == tokenAnchor {
+			if _, ok := anchors[t.dstStart]; !ok {
+				anchors[t.dstStart] = st.anchors[t.srcStart]
+			}
+		}
 	}
-	vstart := pairs[0].vstart
-	vend := pairs[len(pairs)-1].vend
-	arr := byKeyVal{false, json, buf, pairs}
-	sort.Stable(&arr)
-	if !arr.sorted {
-		return buf
+	nbuf := make([]byte, 0, len(buf)+len(anchors)*16)
+	var ends, shifts []int
+	for start := 0; start <= len(buf); {
+		end := bytes.IndexByte(buf[start:], '\n')
+		if end == -1 {
+			end = len(buf)
+		} else {
+			end += start
+		}
+		nbuf = append(nbuf, buf[start:end]...)
+		ends = append(ends, end)
+		shifts = append(shifts, len(nbuf)-end)
+		if pointer, ok := anchors[start]; ok {
+			nbuf = appendBlockComment(nbuf, pointer)
+		}
+		if end < len(buf) {
+			nbuf = append(nbuf, '\n')
+		}
+		start = end + 1
 	}
-	nbuf := make([]byte, 0, vend-vstart)
-	for i, p := range pairs {
-		nbuf = append(nbuf, buf[p.vstart:p.vend]...)
-		if i < len(pairs)-1 {
-			nbuf = append(nbuf, ',')
+	st.moveTokens(ends, shifts)
+	return nbuf
+}
+
+// collapseBlankLines removes the blank lines that follow
+// Options.MaxConsecutiveBlankLines blank lines. The tokens are moved to
+// match.
+func (st *prettyState) collapseBlankLines(buf []byte) []byte {
+	var ends, shifts []int
+	nbuf := make([]byte, 0, len(buf))
+	var blanks int
+	for start := 0; start < len(buf); {
+		end := bytes.IndexByte(buf[start:], '\n')
+		if end == -1 {
+			end = len(buf)
+		} else {
+			end += start
+		}
+		if end < len(buf) && len(bytes.TrimSpace(buf[start:end])) == 0 {
+			blanks++
+			if blanks > st.opts.MaxConsecutiveBlankLines {
+				start = end + 1
+				continue
+			}
+		} else {
+			blanks = 0
+		}
+		ends = append(ends, end)
+		shifts = append(shifts, len(nbuf)-start)
+		nbuf = append(nbuf, buf[start:end]...)
+		if end < len(buf) {
 			nbuf = append(nbuf, '\n')
 		}
+		start = end + 1
 	}
-	return append(buf[:vstart], nbuf...)
+	st.moveTokens(ends, shifts)
+	return nbuf
 }
 
-func appendPrettyString(buf, json []byte, i, nl int) ([]byte, int, int, bool) {
-	s := i
-	i++
-	for ; i < len(json); i++ {
-		if json[i] == '"' {
-			var sc int
-			for j := i - 1; j > s; j-- {
-				if json[j] == '\\' {
-					sc++
-				} else {
-					break
+// moveTokens moves the tokens on each line that ends at ends[i] by
+// shifts[i], after the lines were rewritten.
+func (st *prettyState) moveTokens(ends, shifts []int) {
+	shift := func(pos int) int {
+		i := sort.Search(len(ends), func(i int) bool {
+			return ends[i] >= pos
+		})
+		if i == len(ends) {
+			return pos
+		}
+		return pos + shifts[i]
+	}
+	for i := range st.tokens {
+		st.tokens[i].dstStart = shift(st.tokens[i].dstStart)
+		st.tokens[i].dstEnd = shift(st.tokens[i].dstEnd)
+	}
+}
+
+// hardWrap breaks the lines that are wider than Options.HardWrap. The
+// continuation lines are indented by one more level than the line that is
+// broken. A line is not broken inside of an escape, a terminal color code,
+// or a multibyte character. The tokens are moved to match.
+func (st *prettyState) hardWrap(buf []byte) []byte {
+	limit := st.opts.HardWrap
+	tab := st.opts.TabWidth
+	if tab <= 0 {
+		tab = 8
+	}
+	// breaks are the positions in buf that a newline is inserted before,
+	// and added are the total bytes inserted up to each break
+	var breaks, added []int
+	var cont []byte
+	nbuf := make([]byte, 0, len(buf)+len(buf)/8)
+	for start := 0; start < len(buf); {
+		end := bytes.IndexByte(buf[start:], '\n')
+		if end == -1 {
+			end = len(buf)
+		} else {
+			end += start
+		}
+		j := start
+		for j < end && (buf[j] == ' ' || buf[j] == '\t') {
+			j++
+		}
+		cont = append(append(cont[:0], buf[start:j]...), st.opts.Indent...)
+		if displayWidth(cont, tab) >= limit {
+			cont = cont[:0]
+		}
+		nbuf = append(nbuf, buf[start:j]...)
+		col := displayWidth(buf[start:j], tab)
+		// wrapped is true when the line has more than the indentation
+		wrapped := false
+		str := false
+		for j < end {
+			// the unit at j is not broken, and has a width of w
+			n, w := 1, 1
+			switch c := buf[j]; {
+			case c == 0x1B:
+				for n = 1; j+n < end; n++ {
+					if c := buf[j+n]; c >= 0x40 && c <= 0x7E && c != '[' {
+						n++
+						break
+					}
 				}
+				w = 0
+			case str && c == '\\':
+				n = 2
+				if j+1 < end && buf[j+1] == 'u' {
+					n = 6
+				}
+				if j+n > end {
+					n = end - j
+				}
+				w = n
+			case c >= utf8.RuneSelf:
+				var r rune
+				r, n = utf8.DecodeRune(buf[j:end])
+				w = runeWidth(r)
+			case c == '\t':
+				w = tab
+			case c == '"':
+				str = !str
 			}
-			if sc%2 == 1 {
-				continue
+			if w > 0 && wrapped && col+w > limit {
+				nbuf = append(nbuf, '\n')
+				nbuf = append(nbuf, cont...)
+				breaks = append(breaks, j)
+				added = append(added, len(nbuf)-j)
+				col = displayWidth(cont, tab)
+				wrapped = false
 			}
-			i++
-			break
+			nbuf = append(nbuf, buf[j:j+n]...)
+			if w > 0 {
+				col += w
+				wrapped = true
+			}
+			j += n
+		}
+		if end < len(buf) {
+			nbuf = append(nbuf, '\n')
 		}
+		start = end + 1
 	}
-	return append(buf, json[s:i]...), i, nl, true
+	if len(breaks) > 0 {
+		shift := func(pos int, end bool) int {
+			k := sort.Search(len(breaks), func(k int) bool {
+				return breaks[k] > pos || end && breaks[k] == pos
+			})
+			if k == 0 {
+				return pos
+			}
+			return pos + added[k-1]
+		}
+		for i := range st.tokens {
+			st.tokens[i].dstStart = shift(st.tokens[i].dstStart, false)
+			st.tokens[i].dstEnd = shift(st.tokens[i].dstEnd, true)
+		}
+	}
+	return nbuf
 }
 
-func appendPrettyNumber(buf, json []byte, i, nl int) ([]byte, int, int, bool) {
-	s := i
-	i++
-	for ; i < len(json); i++ {
-		if json[i] <= ' ' || json[i] == ',' || json[i] == ':' || json[i] == ']' || json[i] == '}' {
-			break
+// tooManyLines returns true when the buffer, plus the extra lines, has more
+// than maxLines lines.
+func (st *prettyState) tooManyLines(buf []byte, extra int) bool {
+	if st.maxLines <= 0 {
+		return false
+	}
+	if len(buf) < st.lineMark {
+		st.lineCount, st.lineMark = 0, 0
+	}
+	st.lineCount += bytes.Count(buf[st.lineMark:], []byte{'\n'})
+	st.lineMark = len(buf)
+	return st.lineCount+1+extra > st.maxLines
+}
+
+// defaultMaxNestingDepth is the limit of Options.MaxNestingDepth when it is
+// zero.
+const defaultMaxNestingDepth = 10000
+
+// tooDeep returns true when an object or array at the indentation level
+// tabs is deeper than Options.MaxNestingDepth.
+func (st *prettyState) tooDeep(tabs int) bool {
+	max := st.opts.MaxNestingDepth
+	if max == 0 {
+		max = defaultMaxNestingDepth
+	}
+	return max > 0 && tabs-st.base >= max
+}
+
+// truncMarker is added in place of the elements that did not fit in
+// Options.MaxBytes.
+const truncMarker = "..."
+
+// lineCost returns the number of bytes needed for a new line at the
+// provided depth.
+func (st *prettyState) lineCost(tabs int) int {
+	indent := len(st.opts.Indent)
+	if st.kinds != nil {
+		// the widest indent
+		for _, s := range []string{st.opts.IndentObject, st.opts.IndentArray} {
+			if len(s) > indent {
+				indent = len(s)
+			}
 		}
 	}
-	return append(buf, json[s:i]...), i, nl, true
+	return 1 + len(st.opts.Prefix) + indent*tabs
 }
 
-func appendTabs(buf []byte, prefix, indent string, tabs int) []byte {
-	if len(prefix) != 0 {
-		buf = append(buf, prefix...)
+// fitBytes returns the output, or only the truncation marker when the
+// output does not fit in Options.MaxBytes, such as for a long root string
+// or a MaxBytes that is smaller than the closed brackets.
+func (st *prettyState) fitBytes(buf []byte) []byte {
+	if st.opts.MaxBytes <= 0 || len(buf) <= st.opts.MaxBytes {
+		return buf
 	}
-	if len(indent) == 2 && indent[0] == ' ' && indent[1] == ' ' {
-		for i := 0; i < tabs; i++ {
-			buf = append(buf, ' ', ' ')
+	st.truncated = true
+	st.tokens = st.tokens[:0]
+	buf = buf[:0]
+	if st.opts.MaxBytes >= len(truncMarker) {
+		buf = append(buf, truncMarker...)
+	}
+	return buf
+}
+
+// sortedMembers returns the positions of the members of the object at
+// position i in the sorted order of the keys, for Options.MaxBytes, which
+// cuts the members after sorting. The position of a member is just past
+// the value of the prior member, which keeps the comments prior to the
+// member, and tail is just past the last value.
+func (st *prettyState) sortedMembers(json []byte, i int, bykey bool) (order []int, tail int) {
+	var pairs []pair
+	// j is the start of the member, and k is past its comma
+	for j, k := i+1, i+1; ; k++ {
+		for k = skipSpace(json, k); k < len(json) && isComment(json, k); {
+			k = skipSpace(json, commentEnd(json, k))
 		}
-	} else {
-		for i := 0; i < tabs; i++ {
-			buf = append(buf, indent...)
+		if k >= len(json) || json[k] != '"' {
+			break
+		}
+		p := pair{kstart: k, kend: valueEnd(json, k), vstart: j}
+		v := skipSpace(json, p.kend)
+		if v < len(json) && json[v] == ':' {
+			v = skipSpace(json, v+1)
+		}
+		if v >= len(json) {
+			break
+		}
+		p.vtype = getjtype(json[v:])
+		pairs = append(pairs, p)
+		j = valueEnd(json, v)
+		tail = j
+		for k = skipSpace(json, j); k < len(json) && isComment(json, k); {
+			k = skipSpace(json, commentEnd(json, k))
+		}
+		if j == v || k >= len(json) || json[k] != ',' {
+			break
 		}
 	}
-	return buf
+	arr := byKeyVal{false, json, pairs, st.order, st.opts.KeyCollator,
+		st.opts.GroupByType, bykey, bykey && st.opts.SortBy == SortByValue}
+	sort.Stable(&arr)
+	order = make([]int, len(pairs))
+	for n, p := range pairs {
+		order[n] = p.vstart
+	}
+	return order, tail
 }
 
-// Style is the color style
-type Style struct {
-	Key, String, Number [2]string
-	True, False, Null   [2]string
-	Escape              [2]string
-	Brackets            [2]string
-	Append              func(dst []byte, c byte) []byte
+// overBudget returns true when the buffer, plus the bytes needed for a
+// truncation marker at the provided depth, does not fit in MaxBytes.
+func (st *prettyState) overBudget(buf []byte, tabs int) bool {
+	if st.opts.MaxBytes <= 0 {
+		return false
+	}
+	return len(buf)+st.reserve+1+st.lineCost(tabs+1)+len(truncMarker) >
+		st.opts.MaxBytes
 }
 
-func hexp(p byte) byte {
-	switch {
-	case p < 10:
-		return p + '0'
-	default:
-		return (p - 10) + 'a'
+// flush drops the finished lines after keep from buf, when counting for
+// PrettyLen. The output before keep is left for the callers.
+func (st *prettyState) flush(buf []byte, keep, nl int) ([]byte, int) {
+	if !st.count {
+		return buf, nl
 	}
+	cut := bytes.LastIndexByte(buf[keep:], '\n') + 1
+	st.flushed += cut
+	n := copy(buf[keep:], buf[keep+cut:])
+	return buf[:keep+n], nl - cut
 }
 
-// TerminalStyle is for terminals
-var TerminalStyle *Style
+// appendPunct appends a bracket, colon or comma. The nl is adjusted for the
+// color codes, which do not take up any space on the line.
+func (st *prettyState) appendPunct(buf []byte, c byte, nl int) ([]byte, int) {
+	if st.style == nil {
+		return append(buf, c), nl
+	}
+	n := len(buf)
+	buf = append(buf, st.style.Brackets[0]...)
+	buf = st.style.appendBracket(buf, c, st.apnd)
+	buf = append(buf, st.style.Brackets[1]...)
+	// everything but a single character is hidden
+	return buf, nl + len(buf) - n - 1
+}
 
-func init() {
-	TerminalStyle = &Style{
-		Key:      [2]string{"\x1B[1m\x1B[94m", "\x1B[0m"},
-		String:   [2]string{"\x1B[32m", "\x1B[0m"},
-		Number:   [2]string{"\x1B[33m", "\x1B[0m"},
-		True:     [2]string{"\x1B[36m", "\x1B[0m"},
-		False:    [2]string{"\x1B[36m", "\x1B[0m"},
-		Null:     [2]string{"\x1B[2m", "\x1B[0m"},
-		Escape:   [2]string{"\x1B[35m", "\x1B[0m"},
-		Brackets: [2]string{"\x1B[1m", "\x1B[0m"},
-		Append: func(dst []byte, c byte) []byte {
-			if c < ' ' && (c != '\r' && c != '\n' && c != '\t' && c != '\v') {
-				dst = append(dst, "\\u00"...)
-				dst = append(dst, hexp((c>>4)&0xF))
-				return append(dst, hexp((c)&0xF))
-			}
-			return append(dst, c)
-		},
+// appendComma appends the comma of an object or an array, where open is
+// its opening bracket. The commas of arrays are only colored with
+// Style.ArrayCommas.
+func (st *prettyState) appendComma(buf []byte, open byte, nl int) ([]byte, int) {
+	if open == '[' && st.style != nil && !st.style.ArrayCommas {
+		return append(buf, ','), nl
 	}
+	return st.appendPunct(buf, ',', nl)
 }
 
-// Color will colorize the json. The style parma is used for customizing
-// the colors. Passing nil to the style param will use the default
-// TerminalStyle.
-func Color(src []byte, style *Style) []byte {
-	if style == nil {
-		style = TerminalStyle
+// colorToken wraps the token at buf[d:] with the color codes.
+func (st *prettyState) colorToken(buf []byte, d int, color [2]string, nl int) ([]byte, int) {
+	n := len(buf) - d
+	buf = append(buf, color[0]...)
+	copy(buf[d+len(color[0]):], buf[d:d+n])
+	copy(buf[d:], color[0])
+	buf = append(buf, color[1]...)
+	return buf, nl + len(color[0]) + len(color[1])
+}
+
+// isComment returns true when a // or /* */ comment starts at position i.
+func isComment(json []byte, i int) bool {
+	return json[i] == '/' && i+1 < len(json) &&
+		(json[i+1] == '/' || json[i+1] == '*')
+}
+
+// headerEnd returns the end of the # and comment lines at the start of
+// the json, for Options.PreserveHeader, which is past the newline of the
+// last line.
+func headerEnd(json []byte) int {
+	var end int
+	for i := skipSpace(json, 0); i < len(json); i = skipSpace(json, end) {
+		var j int
+		if json[i] == '#' {
+			if j = bytes.IndexByte(json[i:], '\n'); j == -1 {
+				return len(json)
+			}
+			j += i
+		} else if isComment(json, i) {
+			j = commentEnd(json, i)
+		} else {
+			break
+		}
+		for j < len(json) && (json[j] == ' ' || json[j] == '\t' || json[j] == '\r') {
+			j++
+		}
+		if j < len(json) && json[j] != '\n' {
+			// a value follows the comment on the same line
+			break
+		}
+		if j < len(json) {
+			j++
+		}
+		end = j
 	}
-	apnd := style.Append
-	if apnd == nil {
-		apnd = func(dst []byte, c byte) []byte {
-			return append(dst, c)
+	return end
+}
+
+// commentEnd returns the position just past the comment at position i.
+func commentEnd(json []byte, i int) int {
+	if json[i+1] == '/' {
+		if j := bytes.IndexByte(json[i:], '\n'); j != -1 {
+			return i + j
 		}
+		return len(json)
 	}
-	type stackt struct {
-		kind byte
-		key  bool
+	if j := bytes.Index(json[i+2:], []byte("*/")); j != -1 {
+		return i + 2 + j + 2
 	}
-	var dst []byte
-	var stack []stackt
-	for i := 0; i < len(src); i++ {
-		if src[i] == '"' {
-			key := len(stack) > 0 && stack[len(stack)-1].key
-			if key {
-				dst = append(dst, style.Key[0]...)
+	return len(json)
+}
+
+// appendComment appends the comment without its trailing whitespace.
+func appendComment(buf, comment []byte) []byte {
+	return append(buf, bytes.TrimRight(comment, " \t\r")...)
+}
+
+func appendPrettyAny(buf, json []byte, i int, pretty bool, st *prettyState, tabs, nl, max int) ([]byte, int, int, bool) {
+	for ; i < len(json); i++ {
+		if json[i] <= ' ' {
+			continue
+		}
+		if !st.opts.PreserveComments && isComment(json, i) {
+			i = commentEnd(json, i) - 1
+			continue
+		}
+		if st.opts.PreserveComments && isComment(json, i) {
+			if !pretty && max != -1 {
+				// comments cannot be on a single line
+				return buf, i, nl, false
+			}
+			end := commentEnd(json, i)
+			if !pretty {
+				i = end - 1
+				continue
+			}
+			buf = appendComment(buf, json[i:end])
+			if json[i+1] == '/' {
+				buf, nl = st.appendNewline(buf)
+				buf = st.appendTabs(buf, tabs)
 			} else {
-				dst = append(dst, style.String[0]...)
+				buf = append(buf, ' ')
 			}
-			dst = apnd(dst, '"')
-			esc := false
-			uesc := 0
-			for i = i + 1; i < len(src); i++ {
-				if src[i] == '\\' {
-					if key {
-						dst = append(dst, style.Key[1]...)
-					} else {
-						dst = append(dst, style.String[1]...)
-					}
-					dst = append(dst, style.Escape[0]...)
-					dst = apnd(dst, src[i])
-					esc = true
-					if i+1 < len(src) && src[i+1] == 'u' {
-						uesc = 5
-					} else {
-						uesc = 1
+			i = end - 1
+			continue
+		}
+		if st.opts.ValueFormatter != nil && (isNaNOrInf(json[i:]) ||
+			strings.IndexByte(`"-0123456789tfn`, json[i]) != -1) {
+			d := len(buf)
+			var ok bool
+			if buf, i, nl, ok = st.appendFormattedValue(buf, json, i, pretty, nl); ok {
+				if !pretty && max != -1 && bytes.IndexByte(buf[d:], '\n') != -1 {
+					// like raw values, they cannot be on a single line
+					return buf, i, nl, false
+				}
+				return buf, i, nl, true
+			}
+		}
+		if st.opts.CollapseLargeLeaves > 0 && (json[i] == '"' || json[i] == '-' ||
+			(json[i] >= '0' && json[i] <= '9') || isNaNOrInf(json[i:])) {
+			if end := valueEnd(json, i); end-i > st.opts.CollapseLargeLeaves {
+				d := len(buf)
+				buf = append(appendByteSize(append(buf, '"', '<'), end-i), '>', '"')
+				buf = requote(buf, d, st.opts.DisplayQuote)
+				if st.style != nil {
+					buf, nl = st.colorToken(buf, d, st.style.String, nl)
+				}
+				st.addToken(TokenString, i, end, d, len(buf))
+				if pretty {
+					buf = st.appendPointer(buf)
+				}
+				return buf, end, nl, true
+			}
+		}
+		if json[i] == '"' && st.opts.ExpandEmbeddedJSON {
+			if doc, ok := embeddedJSON(json[i:valueEnd(json, i)]); ok {
+				s, end, tok := i, valueEnd(json, i), len(st.tokens)
+				buf, _, nl, ok = appendPrettyAny(buf, doc, 0, pretty, st, tabs, nl, max)
+				for j := tok; j < len(st.tokens); j++ {
+					// the tokens of the document are from the string
+					if st.tokens[j].kind >= 0 {
+						st.tokens[j].srcStart, st.tokens[j].srcEnd = s, end
 					}
-				} else if esc {
-					dst = apnd(dst, src[i])
-					if uesc == 1 {
-						esc = false
-						dst = append(dst, style.Escape[1]...)
-						if key {
-							dst = append(dst, style.Key[0]...)
+				}
+				return buf, end, nl, ok
+			}
+		}
+		if json[i] == '"' {
+			s, d := i, len(buf)
+			fold := st.opts.RenderEscapedNewlines &&
+				foldable(json[s:valueEnd(json, s)])
+			if fold && !pretty && max != -1 {
+				// folded strings cannot be on a single line
+				return buf, i, nl, false
+			}
+			src, at := json, i
+			if st.opts.FixLoneSurrogates {
+				if str, ok := fixLoneSurrogates(json[i:valueEnd(json, i)]); ok {
+					src, at = str, 0
+				}
+			}
+			var escaped bool
+			if st.opts.EscapeSlashes {
+				var str []byte
+				if str, escaped = slashEscaped(src, at); escaped {
+					src, at = str, 0
+				}
+			}
+			var end int
+			if st.style != nil {
+				buf, end = appendColorString(buf, src, at, false, st.style, st.apnd)
+				nl += (len(buf) - d) - (end - at)
+			} else {
+				buf, end, nl, _ = appendPrettyString(buf, src, at, nl)
+			}
+			if escaped {
+				i = valueEnd(json, s)
+			} else {
+				// the fixed strings have the same length
+				i = s + end - at
+			}
+			if st.opts.ReplaceInvalidUTF8 {
+				buf = replaceInvalidUTF8(buf, d)
+			}
+			buf = requote(buf, d, st.opts.DisplayQuote)
+			if fold && pretty {
+				buf, nl = st.foldNewlines(buf, d, tabs, nl)
+			}
+			st.addToken(TokenString, s, i, d, len(buf))
+			if st.opts.TypeComments {
+				buf = appendTypeComment(buf, json[s:i])
+			}
+			if st.opts.TimeComments {
+				buf = appendTimeComment(buf, json[s:i])
+			}
+			if pretty {
+				buf = st.appendPointer(buf)
+			}
+			return buf, i, nl, true
+		}
+
+		if (json[i] >= '0' && json[i] <= '9') || json[i] == '-' || isNaNOrInf(json[i:]) {
+			s, d := i, len(buf)
+			buf, i, nl, _ = appendPrettyNumber(buf, json, i, nl)
+			num := json[s:i]
+			if st.opts.NormalizeSigns {
+				num = normalizeSigns(num)
+				buf = append(buf[:d], num...)
+			}
+			if st.opts.NumberNotation != NotationPreserve {
+				num = appendNotation(nil, num, st.opts.NumberNotation)
+				buf = append(buf[:d], num...)
+			}
+			if st.opts.GroupDigits {
+				buf = appendGroupedDigits(buf[:d], num)
+			}
+			if st.style != nil {
+				color := st.style.valueColor(buf[d:], st.style.Number)
+				buf, nl = st.colorToken(buf, d, color, nl)
+			}
+			st.addToken(TokenNumber, s, i, d, len(buf))
+			if st.opts.TypeComments {
+				buf = appendTypeComment(buf, json[s:i])
+			}
+			if st.opts.NumberTypeSuffix {
+				buf = appendNumberType(buf, json[s:i])
+			}
+			if st.opts.TimeComments {
+				buf = appendTimeComment(buf, json[s:i])
+			}
+			if pretty {
+				buf = st.appendPointer(buf)
+			}
+			return buf, i, nl, true
+		}
+		if json[i] == '{' || json[i] == '[' {
+			open, close := json[i], byte('}')
+			if open == '[' {
+				close = ']'
+			}
+			d := len(buf)
+			ok := true
+			if st.opts.MaxDepth > 0 && tabs-st.base >= st.opts.MaxDepth ||
+				st.tooDeep(tabs) {
+				buf, i, nl = st.appendCollapsed(buf, json, i, open, close, nl)
+			} else {
+				buf, i, nl, ok = appendPrettyObject(buf, json, i, open, close, pretty, st, tabs, nl, max)
+			}
+			if pretty && bytes.IndexByte(buf[d:], '\n') == -1 {
+				// on a single line, labeled after the closing bracket
+				buf = st.appendPointer(buf)
+			}
+			return buf, i, nl, ok
+		}
+		d := len(buf)
+		switch json[i] {
+		case 't':
+			buf = append(buf, 't', 'r', 'u', 'e')
+			if st.style != nil {
+				buf, nl = st.colorToken(buf, d, st.style.True, nl)
+			}
+			st.addToken(TokenTrue, i, i+4, d, len(buf))
+			if st.opts.TypeComments {
+				buf = appendTypeComment(buf, json[i:i+1])
+			}
+			if pretty {
+				buf = st.appendPointer(buf)
+			}
+			return buf, i + 4, nl, true
+		case 'f':
+			buf = append(buf, 'f', 'a', 'l', 's', 'e')
+			if st.style != nil {
+				color := st.style.valueColor(buf[d:], st.style.False)
+				buf, nl = st.colorToken(buf, d, color, nl)
+			}
+			st.addToken(TokenFalse, i, i+5, d, len(buf))
+			if st.opts.TypeComments {
+				buf = appendTypeComment(buf, json[i:i+1])
+			}
+			if pretty {
+				buf = st.appendPointer(buf)
+			}
+			return buf, i + 5, nl, true
+		case 'n':
+			buf = append(buf, 'n', 'u', 'l', 'l')
+			if st.style != nil {
+				buf, nl = st.colorToken(buf, d, st.style.Null, nl)
+			}
+			st.addToken(TokenNull, i, i+4, d, len(buf))
+			if st.opts.TypeComments {
+				buf = appendTypeComment(buf, json[i:i+1])
+			}
+			if pretty {
+				buf = st.appendPointer(buf)
+			}
+			return buf, i + 4, nl, true
+		}
+	}
+	return buf, i, nl, true
+}
+
+type pair struct {
+	kstart, kend int
+	vstart, vend int
+	vtype        jtype
+}
+
+type byKeyVal struct {
+	sorted  bool
+	json    []byte
+	pairs   []pair
+	order   map[string]int
+	collate func(a, b string) int
+	bytype  bool
+	bykey   bool
+	byval   bool
+}
+
+func (arr *byKeyVal) Len() int {
+	return len(arr.pairs)
+}
+func (arr *byKeyVal) Less(i, j int) bool {
+	if arr.bytype && arr.pairs[i].vtype != arr.pairs[j].vtype {
+		return arr.pairs[i].vtype < arr.pairs[j].vtype
+	}
+	if !arr.bykey {
+		return false
+	}
+	if arr.byval {
+		if arr.isLess(i, j, byVal) {
+			return true
+		}
+		if arr.isLess(j, i, byVal) {
+			return false
+		}
+	}
+	if arr.order != nil {
+		r1, r2 := arr.rank(i), arr.rank(j)
+		if r1 != r2 {
+			return r1 < r2
+		}
+	}
+	if arr.isLess(i, j, byKey) {
+		return true
+	}
+	if arr.isLess(j, i, byKey) {
+		return false
+	}
+	return arr.isLess(i, j, byVal)
+}
+func (arr *byKeyVal) Swap(i, j int) {
+	arr.pairs[i], arr.pairs[j] = arr.pairs[j], arr.pairs[i]
+	arr.sorted = true
+}
+
+// rank returns the position of the key in the order, or the size of the
+// order for unknown keys.
+func (arr *byKeyVal) rank(i int) int {
+	key := parsestr(arr.json[arr.pairs[i].kstart:arr.pairs[i].kend])
+	if r, ok := arr.order[string(key)]; ok {
+		return r
+	}
+	return len(arr.order)
+}
+
+type byKind int
+
+const (
+	byKey byKind = 0
+	byVal byKind = 1
+)
+
+type jtype int
+
+const (
+	jnull jtype = iota
+	jfalse
+	jnumber
+	jstring
+	jtrue
+	jjson
+)
+
+// appendTypeComment appends a comment with the type of the value v.
+func appendTypeComment(buf, v []byte) []byte {
+	buf = append(buf, " /* "...)
+	buf = append(buf, typeName(v)...)
+	return append(buf, " */"...)
+}
+
+// appendNumberType appends a comment with the int or float type of the
+// number, for Options.NumberTypeSuffix.
+func appendNumberType(buf, num []byte) []byte {
+	if bytes.IndexAny(num, ".eE") != -1 || isNaNOrInf(num) {
+		return append(buf, " /* float */"...)
+	}
+	return append(buf, " /* int */"...)
+}
+
+// typeName returns the name of the type of the value v.
+func typeName(v []byte) string {
+	switch getjtype(v) {
+	case jnull:
+		return "null"
+	case jfalse, jtrue:
+		return "boolean"
+	case jnumber:
+		return "number"
+	case jstring:
+		return "string"
+	default:
+		if v[0] == '{' {
+			return "object"
+		}
+		return "array"
+	}
+}
+
+// minEpoch and maxEpoch are the unix times of the years 2000 and 2100.
+// Numbers between them get a comment with Options.TimeComments.
+const (
+	minEpoch = 946684800
+	maxEpoch = 4102444800
+)
+
+// appendTimeComment appends a comment with the UTC time when the string or
+// number v looks like a time.
+func appendTimeComment(buf, v []byte) []byte {
+	var t time.Time
+	if v[0] == '"' {
+		var err error
+		t, err = time.Parse(time.RFC3339Nano, string(parsestr(v)))
+		if err != nil {
+			return buf
+		}
+	} else {
+		if skipDigits(v, 0) != len(v) || (len(v) != 10 && len(v) != 13) {
+			return buf
+		}
+		n, _ := strconv.ParseInt(string(v), 10, 64)
+		if len(v) == 13 {
+			t = time.Unix(n/1000, n%1000*int64(time.Millisecond))
+		} else {
+			t = time.Unix(n, 0)
+		}
+		if t.Unix() < minEpoch || t.Unix() >= maxEpoch {
+			return buf
+		}
+	}
+	buf = append(buf, " /* "...)
+	buf = t.UTC().AppendFormat(buf, "Mon 2006-01-02 15:04:05.999 MST")
+	return append(buf, " */"...)
+}
+
+func getjtype(v []byte) jtype {
+	if len(v) == 0 {
+		return jnull
+	}
+	switch v[0] {
+	case '"':
+		return jstring
+	case 'f':
+		return jfalse
+	case 't':
+		return jtrue
+	case 'n':
+		return jnull
+	case '[', '{':
+		return jjson
+	default:
+		return jnumber
+	}
+}
+
+func (arr *byKeyVal) isLess(i, j int, kind byKind) bool {
+	k1 := arr.json[arr.pairs[i].kstart:arr.pairs[i].kend]
+	k2 := arr.json[arr.pairs[j].kstart:arr.pairs[j].kend]
+	var v1, v2 []byte
+	if kind == byKey {
+		v1 = k1
+		v2 = k2
+	} else {
+		v1 = arr.value(i)
+		v2 = arr.value(j)
+	}
+	if kind == byKey && arr.collate != nil &&
+		getjtype(v1) == jstring && getjtype(v2) == jstring {
+		return arr.collate(string(parsestr(v1)), string(parsestr(v2))) < 0
+	}
+	return lessValues(v1, v2)
+}
+
+// value returns the input value of the pair i. Objects and arrays are
+// compacted, which compares them without their formatting.
+func (arr *byKeyVal) value(i int) []byte {
+	j := skipSpace(arr.json, arr.pairs[i].kend)
+	if j < len(arr.json) && arr.json[j] == ':' {
+		j = skipSpace(arr.json, j+1)
+	}
+	v := arr.json[j:valueEnd(arr.json, j)]
+	if getjtype(v) == jjson {
+		v = Ugly(v)
+	}
+	return v
+}
+
+// lessValues compares two values by their type, and then by their value
+// for strings and numbers.
+func lessValues(v1, v2 []byte) bool {
+	t1 := getjtype(v1)
+	t2 := getjtype(v2)
+	if t1 < t2 {
+		return true
+	}
+	if t1 > t2 {
+		return false
+	}
+	if t1 == jstring {
+		s1 := parsestr(v1)
+		s2 := parsestr(v2)
+		return string(s1) < string(s2)
+	}
+	if t1 == jnumber {
+		n1, _ := strconv.ParseFloat(string(v1), 64)
+		n2, _ := strconv.ParseFloat(string(v2), 64)
+		return n1 < n2
+	}
+	return string(v1) < string(v2)
+}
+
+func parsestr(s []byte) []byte {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' {
+			var str string
+			json.Unmarshal(s, &str)
+			return []byte(str)
+		}
+		if s[i] == '"' {
+			return s[1:i]
+		}
+	}
+	return nil
+}
+
+func appendPrettyObject(buf, json []byte, i int, open, close byte, pretty bool, st *prettyState, tabs, nl, max int) ([]byte, int, int, bool) {
+	allman := pretty && max == -1 && st.opts.BraceStyle == BraceAllman
+	if j := skipSpace(json, i+1); allman && st.allman && j < len(json) &&
+		json[j] != close {
+		// move the brace below the key
+		buf, nl = st.appendNewline(buf)
+		buf = st.appendTabs(buf, tabs)
+	}
+	st.allman = false
+	if pretty && max == -1 && st.opts.CompactArraysOnly {
+		if open == '[' && !allman && !hasObjects(json, i) {
+			s1, s2, s3 := len(buf), i, len(st.tokens)
+			var hidden int
+			var ok bool
+			buf, i, hidden, ok = appendPrettyMembers(buf, json, i, open, close, false, st, tabs, 0, -1)
+			if ok && !st.overBudget(buf, tabs) {
+				return buf, i, nl + hidden, true
+			}
+			buf = buf[:s1]
+			i = s2
+			st.tokens = st.tokens[:s3]
+			if st.opts.ItemsPerLine > 0 && scalarsOnly(json, i) {
+				return appendFilledArray(buf, json, i, st, tabs, nl)
+			}
+		}
+		return appendPrettyMembers(buf, json, i, open, close, pretty, st, tabs, nl, max)
+	}
+	if pretty && max == -1 && open == '[' && st.opts.NeverExpandScalarArrays &&
+		!allman && scalarsOnly(json, i) {
+		if n, _ := countMembers(json, i); (st.opts.MaxInlineArrayElements == 0 ||
+			n <= st.opts.MaxInlineArrayElements) &&
+			(st.opts.ItemsPerLine <= 0 || n <= st.opts.ItemsPerLine) {
+			s1, s2, s3 := len(buf), i, len(st.tokens)
+			var hidden int
+			buf, i, hidden, _ = appendPrettyMembers(buf, json, i, open, close, false, st, tabs, 0, -1)
+			if !st.overBudget(buf, tabs) {
+				return buf, i, nl + hidden, true
+			}
+			buf = buf[:s1]
+			i = s2
+			st.tokens = st.tokens[:s3]
+		}
+	}
+	if st.opts.Width > 0 || st.opts.BreakFunc != nil {
+		if pretty && max == -1 && (open == '[' || st.opts.PackLeafObjects ||
+			st.opts.BreakFunc != nil) {
+			// here we try to create a single line array or object
+			inline, max := true, st.opts.Width-(len(buf)-nl)
+			if st.opts.WidthIgnoresIndent {
+				max = st.opts.Width
+			}
+			if st.opts.BreakFunc != nil {
+				kind := TokenArray
+				if open == '{' {
+					kind = TokenObject
+				}
+				n, _ := countMembers(json, i)
+				inline = !st.opts.BreakFunc(tabs-st.base, kind, n)
+				max = math.MaxInt32
+			}
+			if inline && max > 3 && !allman {
+				s1, s2, s3 := len(buf), i, len(st.tokens)
+				var hidden int
+				var ok bool
+				buf, i, hidden, ok = appendPrettyMembers(buf, json, i, open, close, false, st, tabs, 0, max)
+				if ok && len(buf)-s1-hidden <= max && !st.overBudget(buf, tabs) {
+					return buf, i, nl + hidden, true
+				}
+				buf = buf[:s1]
+				i = s2
+				st.tokens = st.tokens[:s3]
+			}
+			if open == '[' && (st.opts.FillArrays || st.opts.ItemsPerLine > 0) &&
+				scalarsOnly(json, i) {
+				return appendFilledArray(buf, json, i, st, tabs, nl)
+			}
+			if open == '[' && st.opts.PairColumns {
+				if pad := st.pairColumn(json, i, tabs); pad > 0 {
+					return appendPairColumns(buf, json, i, st, tabs, nl, pad)
+				}
+			}
+		} else if max != -1 && open == '{' {
+			return buf, i, nl, false
+		}
+	} else if pretty && max == -1 && open == '[' {
+		if st.opts.ItemsPerLine > 0 && scalarsOnly(json, i) {
+			return appendFilledArray(buf, json, i, st, tabs, nl)
+		}
+		if st.opts.PairColumns {
+			if pad := st.pairColumn(json, i, tabs); pad > 0 {
+				return appendPairColumns(buf, json, i, st, tabs, nl, pad)
+			}
+		}
+	}
+	return appendPrettyMembers(buf, json, i, open, close, pretty, st, tabs, nl, max)
+}
+
+// appendCollapsed appends the number of members of the object or array at
+// position i in place of its members, for Options.MaxDepth.
+func (st *prettyState) appendCollapsed(buf, json []byte, i int, open, close byte, nl int) ([]byte, int, int) {
+	n, end := countMembers(json, i)
+	kind, name := TokenObject, " key"
+	if open == '[' {
+		kind, name = TokenArray, " element"
+	}
+	d := len(buf)
+	buf, nl = st.appendPunct(buf, open, nl)
+	if n > 0 {
+		buf = append(buf, ' ')
+		c := len(buf)
+		buf = strconv.AppendInt(buf, int64(n), 10)
+		if st.style != nil {
+			// colored like Color would
+			buf, nl = st.colorToken(buf, c, st.style.Number, nl)
+		}
+		buf = append(buf, name...)
+		if n > 1 {
+			buf = append(buf, 's')
+		}
+		buf = append(buf, ' ')
+	}
+	buf, nl = st.appendPunct(buf, close, nl)
+	st.addToken(kind, i, end, d, len(buf))
+	return buf, end, nl
+}
+
+// countMembers returns the number of members of the object or array at
+// position i, and the position just past it.
+func countMembers(json []byte, i int) (int, int) {
+	var n, depth int
+	var member bool
+	for i++; i < len(json); i++ {
+		c := json[i]
+		switch {
+		case c <= ' ':
+			continue
+		case isComment(json, i):
+			i = commentEnd(json, i) - 1
+			continue
+		case c == '}' || c == ']':
+			if depth == 0 {
+				return n, i + 1
+			}
+			depth--
+			continue
+		case c == ',' && depth == 0:
+			member = false
+			continue
+		}
+		if depth == 0 && !member {
+			member = true
+			n++
+		}
+		if c == '"' {
+			i = valueEnd(json, i) - 1
+		} else if c == '{' || c == '[' {
+			depth++
+		}
+	}
+	return n, i
+}
+
+// scalarsOnly returns true when the object or array at position i does not
+// contain any objects or arrays.
+func scalarsOnly(json []byte, i int) bool {
+	for i = i + 1; i < len(json); i++ {
+		switch json[i] {
+		case '{', '[', '}':
+			return false
+		case ']':
+			return true
+		case '"':
+			i = valueEnd(json, i) - 1
+		case '/':
+			// comments
+			return false
+		}
+	}
+	return true
+}
+
+// hasObjects returns true when the array at position i contains an object
+// at any depth, or a comment.
+func hasObjects(json []byte, i int) bool {
+	var depth int
+	for ; i < len(json); i++ {
+		switch json[i] {
+		case '{', '/':
+			return true
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return false
+			}
+		case '"':
+			i = valueEnd(json, i) - 1
+		}
+	}
+	return false
+}
+
+// pairColumn returns the width of the first column when the array at
+// position i only contains pairs of scalars, otherwise zero.
+func (st *prettyState) pairColumn(json []byte, i, tabs int) int {
+	var pad, pairs int
+	var scratch []byte
+	tmark := len(st.tokens)
+	defer func() { st.tokens = st.tokens[:tmark] }()
+	for i = skipSpace(json, i+1); i < len(json) && json[i] != ']'; pairs++ {
+		if json[i] != '[' {
+			return 0
+		}
+		for n := 0; n < 2; n++ {
+			i = skipSpace(json, i+1)
+			if i >= len(json) || strings.IndexByte("{[]},:/", json[i]) != -1 {
+				return 0
+			}
+			if n == 0 {
+				var hidden int
+				end := valueEnd(json, i)
+				plen := st.enterPath(nil, pairs)
+				st.enterPath(nil, 0)
+				scratch, _, hidden, _ = appendPrettyAny(scratch[:0], json[:end], i, false, st, tabs+2, 0, -1)
+				st.path = st.path[:plen]
+				if len(scratch)-hidden > pad {
+					pad = len(scratch) - hidden
+				}
+			}
+			i = skipSpace(json, valueEnd(json, i))
+			if i >= len(json) || json[i] != ",]"[n] {
+				return 0
+			}
+		}
+		if i = skipSpace(json, i+1); i < len(json) && json[i] == ',' {
+			i = skipSpace(json, i+1)
+		}
+	}
+	if i >= len(json) {
+		return 0
+	}
+	return pad
+}
+
+// appendPairColumns appends the array of pairs at position i, with one
+// pair on each line and the first elements padded to the pad width.
+func appendPairColumns(buf, json []byte, i int, st *prettyState, tabs, nl, pad int) ([]byte, int, int, bool) {
+	start := i
+	tok := st.addToken(TokenArray, i, i, len(buf), len(buf))
+	st.setKind(tabs, '[')
+	buf, nl = st.appendPunct(buf, '[', nl)
+	buf = st.appendPointer(buf)
+	limited := st.opts.MaxBytes > 0
+	if limited {
+		st.reserve += st.lineCost(tabs) + 1
+	}
+	var n int
+	for i = skipSpace(json, i+1); json[i] != ']'; i = skipSpace(json, i) {
+		mark, tmark := len(buf), len(st.tokens)
+		if n > 0 {
+			buf, nl = st.appendComma(buf, '[', nl)
+		}
+		buf, nl = st.appendNewline(buf)
+		st.addLine(i, len(buf))
+		st.addAnchor(len(buf), n)
+		buf = st.appendTabs(buf, tabs+1)
+		ptok := st.addToken(TokenArray, i, i, len(buf), len(buf))
+		buf, nl = st.appendPunct(buf, '[', nl)
+		for k := 0; k < 2; k++ {
+			// the scalars are cut at the ends found by pairColumn
+			i = skipSpace(json, i+1)
+			end := valueEnd(json, i)
+			mark, hidden := len(buf), nl
+			plen := st.enterPath(nil, n)
+			st.enterPath(nil, k)
+			buf, _, nl, _ = appendPrettyAny(buf, json[:end], i, false, st, tabs+2, nl, -1)
+			st.path = st.path[:plen]
+			i = skipSpace(json, end)
+			if k == 0 {
+				buf, nl = st.appendComma(buf, '[', nl)
+				buf = append(buf, ' ')
+				for w := len(buf) - mark - (nl - hidden); w < pad+2; w++ {
+					buf = append(buf, ' ')
+				}
+			}
+		}
+		buf, nl = st.appendPunct(buf, ']', nl)
+		i++
+		if ptok != -1 {
+			st.tokens[ptok].srcEnd = i
+			st.tokens[ptok].dstEnd = len(buf)
+		}
+		if limited && st.overBudget(buf, tabs) {
+			// the pair does not fit
+			buf = buf[:mark]
+			st.tokens = st.tokens[:tmark]
+			if n > 0 {
+				buf, nl = st.appendComma(buf, '[', nl)
+			}
+			buf, nl = st.appendNewline(buf)
+			buf = st.appendTabs(buf, tabs+1)
+			buf = append(buf, truncMarker...)
+			st.truncated = true
+			i = valueEnd(json, start) - 1
+			break
+		}
+		if i = skipSpace(json, i); json[i] == ',' {
+			i++
+		}
+		n++
+	}
+	if limited {
+		st.reserve -= st.lineCost(tabs) + 1
+	}
+	buf, nl = st.appendNewline(buf)
+	st.addAnchor(len(buf), -1)
+	st.addMatch(len(buf))
+	buf = st.appendTabs(buf, tabs)
+	buf, nl = st.appendPunct(buf, ']', nl)
+	i++
+	if tok != -1 {
+		st.tokens[tok].srcEnd = i
+		st.tokens[tok].dstEnd = len(buf)
+	}
+	return buf, i, nl, true
+}
+
+// appendFilledArray appends the array of scalars at position i with as
+// many elements on each line as fit within the Width.
+func appendFilledArray(buf, json []byte, i int, st *prettyState, tabs, nl int) ([]byte, int, int, bool) {
+	tok := st.addToken(TokenArray, i, i, len(buf), len(buf))
+	buf, nl = st.appendPunct(buf, '[', nl)
+	if st.opts.TypeComments {
+		buf = appendTypeComment(buf, []byte{'['})
+	}
+	buf = st.appendPointer(buf)
+	st.setKind(tabs, '[')
+	head := st.appendTabs([]byte{'\n'}, tabs+1)
+	limited := st.opts.MaxBytes > 0
+	if limited {
+		st.reserve += st.lineCost(tabs) + 1
+	}
+	i++
+	var n int
+	for ; i < len(json); i++ {
+		if json[i] <= ' ' || json[i] == ',' {
+			continue
+		}
+		if json[i] == ']' {
+			break
+		}
+		mark, tmark := len(buf), len(st.tokens)
+		if n > 0 {
+			buf, nl = st.appendComma(buf, '[', nl)
+			// the comma is kept on the line
+			mark = len(buf)
+			buf = append(buf, ' ')
+		}
+		hidden := nl
+		plen := st.enterPath(nil, n)
+		buf, i, nl, _ = appendPrettyAny(buf, json, i, false, st, tabs+1, nl, -1)
+		st.path = st.path[:plen]
+		hidden = nl - hidden
+		if n == 0 || (st.opts.Width > 0 || st.opts.ItemsPerLine <= 0) &&
+			len(buf)-nl+1 > st.opts.Width ||
+			st.opts.ItemsPerLine > 0 && n%st.opts.ItemsPerLine == 0 {
+			// move the element to the start of a new line
+			start := mark
+			if n > 0 {
+				start = mark + 1
+			}
+			elem := len(buf) - start
+			delta := mark + len(head) - start
+			buf = append(buf, head[:delta]...)
+			copy(buf[mark+len(head):], buf[start:start+elem])
+			copy(buf[mark:], head)
+			for j := tmark; j < len(st.tokens); j++ {
+				st.tokens[j].dstStart += delta
+				st.tokens[j].dstEnd += delta
+			}
+			st.addLine(i, mark+1)
+			st.addAnchor(mark+1, n)
+			nl = mark + hidden
+		}
+		if limited && st.overBudget(buf, tabs) {
+			// the element does not fit
+			buf = buf[:mark]
+			st.tokens = st.tokens[:tmark]
+			buf, nl = st.appendNewline(buf)
+			buf = st.appendTabs(buf, tabs+1)
+			buf = append(buf, truncMarker...)
+			st.truncated = true
+			n++
+			break
+		}
+		i--
+		n++
+	}
+	if limited {
+		st.reserve -= st.lineCost(tabs) + 1
+	}
+	if n > 0 {
+		buf, nl = st.appendNewline(buf)
+		st.addAnchor(len(buf), -1)
+		st.addMatch(len(buf))
+		buf = st.appendTabs(buf, tabs)
+	}
+	buf, nl = st.appendPunct(buf, ']', nl)
+	if i < len(json) {
+		i++
+	}
+	if tok != -1 {
+		st.tokens[tok].srcEnd = i
+		st.tokens[tok].dstEnd = len(buf)
+	}
+	return buf, i, nl, true
+}
+
+// appendPrettyMembers appends the object or array at position i. When not
+// pretty, the members are written on a single line.
+func appendPrettyMembers(buf, json []byte, i int, open, close byte, pretty bool, st *prettyState, tabs, nl, max int) ([]byte, int, int, bool) {
+	var ok bool
+	width := st.opts.Width
+	bykey := st.opts.SortKeys || st.order != nil ||
+		(st.opts.SortKeysTopLevelOnly && tabs == st.base)
+	sortkeys := bykey || st.opts.GroupByType
+	blank := pretty && open == '{' && st.opts.BlankLineBetweenEntries &&
+		tabs == st.base
+	kind := TokenArray
+	if open == '{' {
+		kind = TokenObject
+	}
+	tok := st.addToken(kind, i, i, len(buf), len(buf))
+	start := i
+	if pretty {
+		st.setKind(tabs, open)
+	}
+	buf, nl = st.appendPunct(buf, open, nl)
+	label := -1
+	if pretty && (st.opts.TypeComments || st.opts.PointerGutter) {
+		// labeled on the line of the opening bracket
+		label = len(buf)
+		if st.opts.TypeComments {
+			buf = appendTypeComment(buf, json[i:i+1])
+		}
+		buf = st.appendPointer(buf)
+	}
+	keep := len(buf)
+	i++
+	sortelems := open == '[' && st.opts.SortArraysByKey != ""
+	var pairs []pair
+	if open == '{' && sortkeys || sortelems {
+		pairs = make([]pair, 0, 8)
+	}
+	limited := pretty && st.opts.MaxBytes > 0
+	if limited {
+		st.reserve += st.lineCost(tabs) + 1
+	}
+	// order is the sorted order of the members, when they may be cut
+	var order []int
+	var tail int
+	if limited && open == '{' && sortkeys {
+		if order, tail = st.sortedMembers(json, start, bykey); len(order) > 0 {
+			i = order[0]
+		}
+	}
+	var n, more int
+	var comments [][2]int
+	for ; i < len(json); i++ {
+		if json[i] <= ' ' || json[i] == ',' {
+			continue
+		}
+		if json[i] == close {
+			break
+		}
+		if open == '{' && !sortkeys && st.opts.MaxObjectKeys > 0 &&
+			n == st.opts.MaxObjectKeys && !isComment(json, i) {
+			// skip the other members, which are counted
+			total, end := countMembers(json, start)
+			more = total - n
+			comments = comments[:0]
+			i = end - 1
+			break
+		}
+		if !st.opts.PreserveComments && isComment(json, i) {
+			i = commentEnd(json, i) - 1
+			continue
+		}
+		if st.opts.PreserveComments && isComment(json, i) {
+			if !pretty && max != -1 {
+				// comments cannot be on a single line
+				return buf, i, nl, false
+			}
+			end := commentEnd(json, i)
+			if !pretty {
+				i = end - 1
+				continue
+			}
+			comments = append(comments, [2]int{i, end})
+			i = end - 1
+			continue
+		}
+		if open == '[' || json[i] == '"' {
+			if !pretty && open == '[' && (st.opts.MaxInlineArrayElements > 0 &&
+				n >= st.opts.MaxInlineArrayElements ||
+				st.opts.ItemsPerLine > 0 && n >= st.opts.ItemsPerLine) {
+				return buf, i, nl, false
+			}
+			mark, tmark, start := len(buf), len(st.tokens), i
+			if n > 0 {
+				buf, nl = st.appendComma(buf, open, nl)
+				if width != -1 && (pretty || open == '{' ||
+					!st.opts.NoPackedArraySpace) {
+					buf = append(buf, ' ')
+				}
+			}
+			var p pair
+			var key []byte
+			var line int
+			if pretty {
+				buf, nl = st.appendNewline(buf)
+				if blank && n > 0 {
+					buf, nl = st.appendNewline(buf)
+				}
+			}
+			if open == '{' && sortkeys {
+				p.kstart = i
+				p.vstart = len(buf)
+			} else if sortelems {
+				// the key range is the range of the value to sort by
+				p.kstart, p.kend = -1, -1
+				p.vstart = len(buf)
+				if json[i] != '{' {
+					sortelems = false
+				} else if j, ok := childAt(json, i, st.opts.SortArraysByKey); ok {
+					p.kstart, p.kend = j, valueEnd(json, j)
+				}
+			}
+			if pretty {
+				line = len(buf)
+				st.addLine(i, line)
+				buf = st.appendTabs(buf, tabs+1)
+				for _, c := range comments {
+					buf = appendComment(buf, json[c[0]:c[1]])
+					buf, nl = st.appendNewline(buf)
+					line = len(buf)
+					buf = st.appendTabs(buf, tabs+1)
+				}
+				comments = comments[:0]
+			}
+			if open == '{' {
+				s, d := i, len(buf)
+				src, at := json, i
+				if st.opts.MaxKeyLength > 0 {
+					if k, ok := truncKey(json, i, st.opts.MaxKeyLength); ok {
+						src, at = k, 0
+					}
+				}
+				if st.opts.FixLoneSurrogates {
+					if k, ok := fixLoneSurrogates(src[at:valueEnd(src, at)]); ok {
+						src, at = k, 0
+					}
+				}
+				if st.opts.EscapeSlashes {
+					if k, ok := slashEscaped(src, at); ok {
+						src, at = k, 0
+					}
+				}
+				var end int
+				var name []byte
+				var unquote bool
+				if st.opts.UnquoteSafeKeys {
+					name, unquote = safeKey(src, at)
+				}
+				if unquote {
+					end = at + len(name) + 2
+					if st.style != nil {
+						buf = append(buf, st.style.Key[0]...)
+						for _, c := range name {
+							buf = st.apnd(buf, c)
+						}
+						buf = append(buf, st.style.Key[1]...)
+						nl += (len(buf) - d) - len(name)
+					} else {
+						buf = append(buf, name...)
+					}
+				} else if st.style != nil {
+					buf, end = appendColorString(buf, src, at, true, st.style, st.apnd)
+					nl += (len(buf) - d) - (end - at)
+				} else {
+					buf, end, nl, _ = appendPrettyString(buf, src, at, nl)
+				}
+				if at == i {
+					i = end
+				} else {
+					i = valueEnd(json, i)
+				}
+				key = json[s:i]
+				if st.opts.ReplaceInvalidUTF8 {
+					buf = replaceInvalidUTF8(buf, d)
+				}
+				if !unquote {
+					buf = requote(buf, d, st.opts.DisplayQuote)
+				}
+				st.addToken(TokenKey, s, i, d, len(buf))
+				if sortkeys {
+					p.kend = i
+				}
+				buf, nl = st.appendPunct(buf, ':', nl)
+				buf = append(buf, ' ')
+				j := skipSpace(json, i)
+				if j < len(json) && json[j] == ':' {
+					j = skipSpace(json, j+1)
+				}
+				if sortkeys && j < len(json) {
+					p.vtype = getjtype(json[j:])
+				}
+				if !pretty {
+					// only objects with scalar values are packed
+					if j < len(json) && (json[j] == '{' || json[j] == '[') {
+						return buf, i, nl, false
+					}
+				}
+			}
+			var qlen int
+			if pretty && (st.opts.PointerGutter || st.opts.AnchorComments) {
+				qlen = len(st.pointer)
+				st.pointer = appendPointer(st.pointer, key, n)
+				st.addAnchor(line, -1)
+			}
+			mlen, mkey := len(st.match), st.matchKey
+			if pretty && st.opts.BracketMatchComments {
+				st.match, st.matchKey = st.appendMatch(key, n)
+			}
+			plen := st.enterPath(key, n)
+			if st.raw != nil && st.raw[string(st.path)] {
+				buf, i, nl, ok = appendRawValue(buf, json, i, pretty, st, nl, max)
+			} else {
+				st.allman = open == '{'
+				buf, i, nl, ok = appendPrettyAny(buf, json, i, pretty, st, tabs+1, nl, max)
+				st.allman = false
+			}
+			st.path = st.path[:plen]
+			if pretty && (st.opts.PointerGutter || st.opts.AnchorComments) {
+				st.pointer = st.pointer[:qlen]
+			}
+			st.match, st.matchKey = st.match[:mlen], mkey
+			if (max != -1 || !pretty) && !ok {
+				return buf, i, nl, false
+			}
+			if pretty && st.maxLines > 0 && (st.stopped || st.tooManyLines(buf, 0)) {
+				// the element does not fit, or one of its children
+				// stopped formatting.
+				if st.tooManyLines(buf, 0) {
+					buf = buf[:mark]
+					st.tokens = st.tokens[:tmark]
+					st.consumed = start
+					if n > 0 {
+						// keep the comma, like the full output
+						buf, _ = st.appendComma(buf, open, nl)
+					}
+				}
+				st.stopped = true
+				return buf, i, nl, true
+			}
+			if limited && (st.truncated || st.overBudget(buf, tabs)) {
+				// the element does not fit, or one of its children was
+				// truncated.
+				if !st.truncated || st.overBudget(buf, tabs) {
+					buf = buf[:mark]
+					st.tokens = st.tokens[:tmark]
+					if n > 0 {
+						buf, _ = st.appendComma(buf, open, nl)
+					}
+					buf, nl = st.appendNewline(buf)
+					buf = st.appendTabs(buf, tabs+1)
+					buf = append(buf, truncMarker...)
+					st.truncated = true
+				}
+				n++
+				break
+			}
+			if open == '{' && sortkeys {
+				p.vend = len(buf)
+				if p.kstart > p.kend || p.vstart > p.vend {
+					// bad data. disable sorting
+					sortkeys = false
+				} else {
+					pairs = append(pairs, p)
+				}
+			} else if sortelems {
+				p.vend = len(buf)
+				pairs = append(pairs, p)
+			}
+			if pretty {
+				buf, nl = st.flush(buf, keep, nl)
+			}
+			i--
+			n++
+			if order != nil {
+				// the next member in sorted order
+				if n < len(order) {
+					i = order[n] - 1
+				} else {
+					i = tail - 1
+				}
+			}
+		}
+	}
+	if limited {
+		st.reserve -= st.lineCost(tabs) + 1
+	}
+	if i < len(json) && json[i] == close || st.truncated && limited {
+		extra := 1
+		if more > 0 || sortkeys && st.opts.MaxObjectKeys > 0 &&
+			len(pairs) > st.opts.MaxObjectKeys {
+			extra++
+		}
+		if pretty && n+len(comments) > 0 && st.tooManyLines(buf, extra) {
+			// no room for the closing line
+			st.stopped = true
+			st.consumed = i
+			return buf, i, nl, true
+		}
+		if open == '{' && sortkeys && !st.truncated {
+			buf, more = sortPairs(json, buf, pairs, st, tok, bykey)
+		} else if sortelems && !st.truncated {
+			buf = sortElements(json, buf, pairs, st, tok)
+		}
+		if more > 0 {
+			buf, nl = st.appendComma(buf, open, nl)
+			if pretty {
+				buf, nl = st.appendNewline(buf)
+				st.addLine(i, len(buf))
+				buf = st.appendTabs(buf, tabs+1)
+			} else {
+				buf = append(buf, ' ')
+			}
+			buf, nl = st.appendMoreKeys(buf, more, nl)
+		}
+		if pretty && len(comments) > 0 {
+			// comments that follow the last member
+			for _, c := range comments {
+				buf, nl = st.appendNewline(buf)
+				buf = st.appendTabs(buf, tabs+1)
+				buf = appendComment(buf, json[c[0]:c[1]])
+			}
+			n++
+		}
+		if label != -1 && n == 0 {
+			// empty, labeled after the closing bracket
+			buf = buf[:label]
+		}
+		if pretty && n > 0 {
+			buf, nl = st.appendNewline(buf)
+			st.addAnchor(len(buf), -1)
+			st.addMatch(len(buf))
+			buf = st.appendTabs(buf, tabs)
+		}
+		buf, nl = st.appendPunct(buf, close, nl)
+		if i < len(json) && json[i] == close {
+			i++
+		}
+		if tok != -1 {
+			st.tokens[tok].srcEnd = i
+			st.tokens[tok].dstEnd = len(buf)
+		}
+		if st.opts.TypeComments && (!pretty || n == 0) {
+			buf = appendTypeComment(buf, []byte{open})
+		}
+		// objects are only completed when not pretty if they are packed
+		return buf, i, nl, open != '{' || !pretty
+	}
+	return buf, i, nl, open != '{'
+}
+
+// sortPairs sorts the pairs of an object. The pairs are joined with the
+// separator that is between the first two pairs. The keys are only compared
+// when bykey, otherwise the pairs are only grouped by type. Returns the
+// number of pairs that were cut by Options.MaxObjectKeys.
+func sortPairs(json, buf []byte, pairs []pair, st *prettyState, tok int, bykey bool) ([]byte, int) {
+	if len(pairs) < 2 {
+		return buf, 0
+	}
+	arr := byKeyVal{false, json, pairs, st.order, st.opts.KeyCollator,
+		st.opts.GroupByType, bykey, bykey && st.opts.SortBy == SortByValue}
+	sep := buf[pairs[0].vend:pairs[1].vstart]
+	vstart := pairs[0].vstart
+	sort.Stable(&arr)
+	kept := pairs
+	if st.opts.DedupKeys && bykey {
+		kept = dedupPairs(json, pairs)
+	}
+	var more int
+	if max := st.opts.MaxObjectKeys; max > 0 && len(kept) > max {
+		more = len(kept) - max
+		kept = kept[:max]
+	}
+	if !arr.sorted && len(kept) == len(pairs) {
+		return buf, 0
+	}
+	return joinPairs(buf, kept, sep, vstart, st, tok), more
+}
+
+// appendMoreKeys appends the marker of the members that were cut by
+// Options.MaxObjectKeys.
+func (st *prettyState) appendMoreKeys(buf []byte, more, nl int) ([]byte, int) {
+	d := len(buf)
+	buf = append(buf, "\"… ("...)
+	buf = strconv.AppendInt(buf, int64(more), 10)
+	if more == 1 {
+		buf = append(buf, " more key)\""...)
+	} else {
+		buf = append(buf, " more keys)\""...)
+	}
+	// the ellipsis is a single character
+	nl += len("…") - 1
+	if st.style != nil {
+		buf, nl = st.colorToken(buf, d, st.style.String, nl)
+	}
+	return buf, nl
+}
+
+// dedupPairs returns the pairs without the pairs of the keys that appear
+// again later in the object.
+func dedupPairs(json []byte, pairs []pair) []pair {
+	last := make(map[string]int, len(pairs))
+	for _, p := range pairs {
+		key := string(parsestr(json[p.kstart:p.kend]))
+		if p.vstart >= last[key] {
+			last[key] = p.vstart
+		}
+	}
+	if len(last) == len(pairs) {
+		return pairs
+	}
+	kept := make([]pair, 0, len(last))
+	for _, p := range pairs {
+		if last[string(parsestr(json[p.kstart:p.kend]))] == p.vstart {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// sortElements sorts the elements of an array of objects by the values of
+// Options.SortArraysByKey, which are at the key ranges of the pairs.
+// Elements without the key go last.
+func sortElements(json, buf []byte, pairs []pair, st *prettyState, tok int) []byte {
+	if len(pairs) < 2 {
+		return buf
+	}
+	sep := buf[pairs[0].vend:pairs[1].vstart]
+	vstart := pairs[0].vstart
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].kstart == -1 || pairs[j].kstart == -1 {
+			return pairs[j].kstart == -1 && pairs[i].kstart != -1
+		}
+		return lessValues(json[pairs[i].kstart:pairs[i].kend],
+			json[pairs[j].kstart:pairs[j].kend])
+	})
+	for i := 1; i < len(pairs); i++ {
+		if pairs[i].vstart < pairs[i-1].vstart {
+			return joinPairs(buf, pairs, sep, vstart, st, tok)
+		}
+	}
+	return buf
+}
+
+// joinPairs writes the pairs, which are in their new order, in place of
+// the pairs that start at vstart, with the separator between them. When
+// tokens are collected, the tokens that follow the object or array token at
+// index tok are moved along with their pairs, and the tokens of the pairs
+// that were dropped are removed.
+func joinPairs(buf []byte, pairs []pair, sep []byte, vstart int, st *prettyState, tok int) []byte {
+	var vend int
+	for _, p := range pairs {
+		if p.vend > vend {
+			vend = p.vend
+		}
+	}
+	nbuf := make([]byte, 0, vend-vstart)
+	type move struct{ start, end, to int }
+	var moves []move
+	if tok != -1 {
+		moves = make([]move, 0, len(pairs))
+	}
+	for i, p := range pairs {
+		if moves != nil {
+			moves = append(moves, move{p.vstart, p.vend, vstart + len(nbuf)})
+		}
+		nbuf = append(nbuf, buf[p.vstart:p.vend]...)
+		if i < len(pairs)-1 {
+			nbuf = append(nbuf, sep...)
+		}
+	}
+	if moves != nil {
+		sort.Slice(moves, func(i, j int) bool {
+			return moves[i].start < moves[j].start
+		})
+		n := tok + 1
+		for i := tok + 1; i < len(st.tokens); i++ {
+			t := st.tokens[i]
+			j := sort.Search(len(moves), func(j int) bool {
+				return moves[j].end > t.dstStart
+			})
+			if j < len(moves) && moves[j].start <= t.dstStart {
+				delta := moves[j].to - moves[j].start
+				t.dstStart += delta
+				t.dstEnd += delta
+				st.tokens[n] = t
+				n++
+			}
+		}
+		st.tokens = st.tokens[:n]
+	}
+	return append(buf[:vstart], nbuf...)
+}
+
+func appendPrettyString(buf, json []byte, i, nl int) ([]byte, int, int, bool) {
+	end := scanString(json, i)
+	return append(buf, json[i:end]...), end, nl, true
+}
+
+// scanString returns the position just past the string at position i of
+// src, or len(src) when the string does not end. A quote ends the string
+// unless it is escaped, which is when it follows an odd number of
+// backslashes.
+func scanString(src []byte, i int) int {
+	for i = i + 1; i < len(src); i++ {
+		if src[i] == '\\' {
+			i++
+		} else if src[i] == '"' {
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+// appendPath appends the name of a member to the dotted path, which is
+// the key for objects and the index n for arrays.
+func appendPath(path, key []byte, n int) []byte {
+	if len(path) > 0 {
+		path = append(path, '.')
+	}
+	if key == nil {
+		return strconv.AppendInt(path, int64(n), 10)
+	}
+	return append(path, parsestr(key)...)
+}
+
+// appendPointer appends the name of a member to the JSON Pointer, which is
+// the key for objects and the index n for arrays.
+func appendPointer(pointer, key []byte, n int) []byte {
+	pointer = append(pointer, '/')
+	if key == nil {
+		return strconv.AppendInt(pointer, int64(n), 10)
+	}
+	for _, c := range parsestr(key) {
+		switch c {
+		case '~':
+			pointer = append(pointer, '~', '0')
+		case '/':
+			pointer = append(pointer, '~', '1')
+		default:
+			pointer = append(pointer, c)
+		}
+	}
+	return pointer
+}
+
+// appendPointer appends a comment with the JSON Pointer of the current
+// value for Options.PointerGutter. The root value is not labeled.
+func (st *prettyState) appendPointer(buf []byte) []byte {
+	if !st.opts.PointerGutter || len(st.pointer) == 0 {
+		return buf
+	}
+	return appendBlockComment(buf, string(st.pointer))
+}
+
+// appendBlockComment appends the text as a /* */ comment, which is kept
+// on the line when the output is compacted by Ugly. A */ in the text is
+// written as *\/, which does not end the comment.
+func appendBlockComment(buf []byte, text string) []byte {
+	buf = append(buf, " /* "...)
+	buf = append(buf, strings.Replace(text, "*/", "*\\/", -1)...)
+	return append(buf, " */"...)
+}
+
+// appendMatch appends the key, or the index n of an array, to the label of
+// Options.BracketMatchComments, and returns the label and the start of its
+// key.
+func (st *prettyState) appendMatch(key []byte, n int) ([]byte, int) {
+	if key == nil {
+		match := append(strconv.AppendInt(append(st.match, '['), int64(n), 10), ']')
+		return match, st.matchKey
+	}
+	return append(st.match, parsestr(key)...), len(st.match)
+}
+
+// enterPath appends the member to the dotted path, when the path is used
+// by Options.RawPaths or Options.ValueFormatter, and returns the prior
+// length of the path.
+func (st *prettyState) enterPath(key []byte, n int) int {
+	plen := len(st.path)
+	if st.raw != nil || st.opts.ValueFormatter != nil {
+		st.path = appendPath(st.path, key, n)
+	}
+	return plen
+}
+
+// appendFormattedValue appends the output of Options.ValueFormatter for the
+// scalar value at position i, or returns false when the value is not
+// replaced.
+func (st *prettyState) appendFormattedValue(buf, json []byte, i int, pretty bool, nl int) ([]byte, int, int, bool) {
+	end := valueEnd(json, i)
+	if end == i {
+		return buf, i, nl, false
+	}
+	kind := tokenKind(json[i:end])
+	out, ok := st.opts.ValueFormatter(string(st.path), json[i:end], kind)
+	if !ok {
+		return buf, i, nl, false
+	}
+	d := len(buf)
+	buf = append(buf, out...)
+	if j := bytes.LastIndexByte(out, '\n'); j != -1 {
+		nl = d + j
+	}
+	if st.style != nil {
+		color := st.style.String
+		switch kind {
+		case TokenNumber:
+			color = st.style.Number
+		case TokenTrue:
+			color = st.style.True
+		case TokenFalse:
+			color = st.style.False
+		case TokenNull:
+			color = st.style.Null
+		}
+		color = st.style.valueColor(buf[d:], color)
+		buf, nl = st.colorToken(buf, d, color, nl)
+	}
+	st.addToken(kind, i, end, d, len(buf))
+	if pretty {
+		buf = st.appendPointer(buf)
+	}
+	return buf, end, nl, true
+}
+
+// tokenKind returns the kind of the value v.
+func tokenKind(v []byte) TokenKind {
+	switch getjtype(v) {
+	case jstring:
+		return TokenString
+	case jnumber:
+		return TokenNumber
+	case jtrue:
+		return TokenTrue
+	case jfalse:
+		return TokenFalse
+	case jnull:
+		return TokenNull
+	}
+	if v[0] == '{' {
+		return TokenObject
+	}
+	return TokenArray
+}
+
+// appendRawValue appends the value at position i as is, for
+// Options.RawPaths. When not pretty, values with newlines do not fit. With
+// Options.Colorize, the value is colored like Color would.
+func appendRawValue(buf, json []byte, i int, pretty bool, st *prettyState, nl, max int) ([]byte, int, int, bool) {
+	i = skipSpace(json, i)
+	if i < len(json) && json[i] == ':' {
+		i = skipSpace(json, i+1)
+	}
+	end := valueEnd(json, i)
+	raw := json[i:end]
+	if !pretty && max != -1 && bytes.IndexByte(raw, '\n') != -1 {
+		return buf, i, nl, false
+	}
+	d := len(buf)
+	if st.style != nil {
+		buf = appendColor(buf, raw, st.style, nil)
+	} else {
+		buf = append(buf, raw...)
+	}
+	line := d
+	if j := bytes.LastIndexByte(buf[d:], '\n'); j != -1 {
+		nl = d + j
+		line = nl
+	}
+	if st.style != nil {
+		nl += colorCodes(buf[line:])
+	}
+	st.addToken(tokenKind(raw), i, end, d, len(buf))
+	return buf, end, nl, true
+}
+
+// truncKey returns the key at position i cut to max characters, followed by
+// a truncation marker, or false when the key is not longer than max.
+func truncKey(json []byte, i, max int) ([]byte, bool) {
+	end := valueEnd(json, i)
+	if end-i-2 <= max {
+		return nil, false
+	}
+	var n int
+	for j := i + 1; j < end-1; n++ {
+		if n == max {
+			key := append([]byte(nil), json[i:j]...)
+			key = append(key, truncMarker...)
+			return append(key, '"'), true
+		}
+		if json[j] == '\\' {
+			if j+1 < end-1 && json[j+1] == 'u' {
+				j += 6
+			} else {
+				j += 2
+			}
+		} else {
+			_, size := utf8.DecodeRune(json[j:])
+			j += size
+		}
+	}
+	return nil, false
+}
+
+// appendByteSize appends the size of n bytes, such as 900 B or 8.2 KB, for
+// Options.CollapseLargeLeaves.
+func appendByteSize(buf []byte, n int) []byte {
+	if n < 1024 {
+		return append(strconv.AppendInt(buf, int64(n), 10), " B"...)
+	}
+	size := float64(n) / 1024
+	unit := " KB"
+	for _, u := range []string{" MB", " GB", " TB"} {
+		if size < 1024 {
+			break
+		}
+		size /= 1024
+		unit = u
+	}
+	return append(strconv.AppendFloat(buf, size, 'f', 1, 64), unit...)
+}
+
+// embeddedJSON returns the content of the string when it is an encoded JSON
+// object or array, for Options.ExpandEmbeddedJSON.
+func embeddedJSON(str []byte) ([]byte, bool) {
+	if len(str) < 2 || str[len(str)-1] != '"' {
+		return nil, false
+	}
+	doc := bytes.TrimSpace(parsestr(str))
+	if len(doc) < 2 || !(doc[0] == '{' && doc[len(doc)-1] == '}' ||
+		doc[0] == '[' && doc[len(doc)-1] == ']') || !json.Valid(doc) {
+		return nil, false
+	}
+	return doc, true
+}
+
+// foldMarker is written at the end of the lines of folded strings, for
+// Options.RenderEscapedNewlines.
+const foldMarker = "↩"
+
+// foldable returns true when the string has a \n escape that is not at its
+// end.
+func foldable(str []byte) bool {
+	for i := 1; i < len(str)-1; i++ {
+		if str[i] == '\\' {
+			i++
+			if str[i] == 'n' && i+1 < len(str)-1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// foldNewlines breaks the string at buf[d:] onto continuation lines after
+// each \n escape that is not at the end of the string. The color codes of
+// the string, if any, are skipped and kept on the lines they belong to.
+func (st *prettyState) foldNewlines(buf []byte, d, tabs, nl int) ([]byte, int) {
+	str := append([]byte(nil), buf[d:]...)
+	buf = buf[:d]
+	var esc, fold bool
+	for i := 0; i < len(str); i++ {
+		if str[i] == 0x1B {
+			if k := bytes.IndexByte(str[i:], 'm'); k != -1 {
+				buf = append(buf, str[i:i+k+1]...)
+				i += k
+				continue
+			}
+		}
+		if fold && str[i] != '"' {
+			buf = append(buf, foldMarker...)
+			buf, nl = st.appendNewline(buf)
+			buf = st.appendTabs(buf, tabs+1)
+		}
+		fold = esc && str[i] == 'n'
+		esc = !esc && str[i] == '\\'
+		buf = append(buf, str[i])
+	}
+	if st.style != nil {
+		// the color codes of the last line
+		nl += colorCodes(buf[nl:])
+	}
+	return buf, nl
+}
+
+// colorCodes returns the number of bytes of the terminal color codes in b,
+// which are not visible.
+func colorCodes(b []byte) int {
+	var n int
+	for j := 0; j < len(b); j++ {
+		if b[j] == 0x1B {
+			if k := bytes.IndexByte(b[j:], 'm'); k != -1 {
+				n += k + 1
+				j += k
+			}
+		}
+	}
+	return n
+}
+
+// slashEscaped returns the string at position i with its forward slashes
+// escaped, for Options.EscapeSlashes, or false when it has no slashes. The
+// slashes are escaped prior to coloring, so they are colored as escapes.
+func slashEscaped(json []byte, i int) ([]byte, bool) {
+	str := json[i:valueEnd(json, i)]
+	if bytes.IndexByte(str, '/') == -1 {
+		return nil, false
+	}
+	return escapeSlashes(nil, str), true
+}
+
+// escapeSlashes appends the string with its forward slashes escaped.
+// Slashes that are already escaped are left alone.
+func escapeSlashes(buf, str []byte) []byte {
+	for i := 0; i < len(str); i++ {
+		switch str[i] {
+		case '\\':
+			if i+1 < len(str) {
+				buf = append(buf, '\\', str[i+1])
+				i++
+				continue
+			}
+		case '/':
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, str[i])
+	}
+	return buf
+}
+
+// requote changes the double quotes of the string at buf[d:] to the quote
+// q, for Options.DisplayQuote. The double quotes in the string are no longer
+// escaped, and the quotes q are escaped. Terminal color codes are left
+// alone. Nothing is changed when q is zero or a double quote.
+func requote(buf []byte, d int, q byte) []byte {
+	if q == 0 || q == '"' {
+		return buf
+	}
+	str := append([]byte(nil), buf[d:]...)
+	buf = buf[:d]
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == 0x1B:
+			j := i + 1
+			for ; j < len(str); j++ {
+				if c := str[j]; c >= 0x40 && c <= 0x7E && c != '[' {
+					break
+				}
+			}
+			if j == len(str) {
+				j--
+			}
+			buf = append(buf, str[i:j+1]...)
+			i = j
+		case c == '\\' && i+1 < len(str):
+			if str[i+1] != '"' {
+				buf = append(buf, '\\')
+			}
+			buf = append(buf, str[i+1])
+			i++
+		case c == '"':
+			buf = append(buf, q)
+		case c == q:
+			buf = append(buf, '\\', q)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// reservedWords are the ECMAScript reserved words, which are not written
+// without quotes by Options.UnquoteSafeKeys.
+var reservedWords = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true,
+	"const": true, "continue": true, "debugger": true, "default": true,
+	"delete": true, "do": true, "else": true, "enum": true, "export": true,
+	"extends": true, "false": true, "finally": true, "for": true,
+	"function": true, "if": true, "implements": true, "import": true,
+	"in": true, "instanceof": true, "interface": true, "let": true,
+	"new": true, "null": true, "package": true, "private": true,
+	"protected": true, "public": true, "return": true, "static": true,
+	"super": true, "switch": true, "this": true, "throw": true, "true": true,
+	"try": true, "typeof": true, "var": true, "void": true, "while": true,
+	"with": true, "yield": true,
+}
+
+// safeKey returns the key at position i without its quotes, or false when
+// the key is not an ASCII identifier or is a reserved word.
+func safeKey(json []byte, i int) ([]byte, bool) {
+	end := valueEnd(json, i)
+	if end-i < 3 || json[end-1] != '"' {
+		return nil, false
+	}
+	name := json[i+1 : end-1]
+	for j, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' ||
+			c == '$' || j > 0 && c >= '0' && c <= '9') {
+			return nil, false
+		}
+	}
+	if reservedWords[string(name)] {
+		return nil, false
+	}
+	return name, true
+}
+
+// fixLoneSurrogates returns a copy of the string with the \u escapes of
+// lone surrogates replaced by \uFFFD, or false when there are none.
+func fixLoneSurrogates(str []byte) ([]byte, bool) {
+	var fixed []byte
+	for i := 0; i < len(str); i++ {
+		if str[i] != '\\' {
+			continue
+		}
+		r := escapedRune(str, i)
+		if r >= 0xD800 && r < 0xDC00 {
+			if r2 := escapedRune(str, i+6); r2 >= 0xDC00 && r2 < 0xE000 {
+				// a valid pair
+				i += 11
+				continue
+			}
+		} else if r < 0xDC00 || r >= 0xE000 {
+			// skip the escaped character
+			i++
+			continue
+		}
+		if fixed == nil {
+			fixed = append([]byte(nil), str...)
+		}
+		copy(fixed[i:], `\uFFFD`)
+		i += 5
+	}
+	return fixed, fixed != nil
+}
+
+// escapedRune returns the value of the \u escape at position i, or -1 when
+// there is no \u escape.
+func escapedRune(str []byte, i int) rune {
+	if i+6 > len(str) || str[i] != '\\' || str[i+1] != 'u' {
+		return -1
+	}
+	var r rune
+	for _, c := range str[i+2 : i+6] {
+		switch {
+		case c >= '0' && c <= '9':
+			r = r<<4 | rune(c-'0')
+		case c >= 'a' && c <= 'f':
+			r = r<<4 | rune(c-'a'+10)
+		case c >= 'A' && c <= 'F':
+			r = r<<4 | rune(c-'A'+10)
+		default:
+			return -1
+		}
+	}
+	return r
+}
+
+// replaceInvalidUTF8 replaces each invalid UTF-8 byte of the string at
+// buf[d:] with the Unicode replacement character.
+func replaceInvalidUTF8(buf []byte, d int) []byte {
+	if utf8.Valid(buf[d:]) {
+		return buf
+	}
+	str := append([]byte(nil), buf[d:]...)
+	buf = buf[:d]
+	for i := 0; i < len(str); {
+		r, n := utf8.DecodeRune(str[i:])
+		if r == utf8.RuneError && n == 1 {
+			buf = append(buf, "\uFFFD"...)
+		} else {
+			buf = append(buf, str[i:i+n]...)
+		}
+		i += n
+	}
+	return buf
+}
+
+func appendPrettyNumber(buf, json []byte, i, nl int) ([]byte, int, int, bool) {
+	s := i
+	i++
+	for ; i < len(json); i++ {
+		if json[i] <= ' ' || json[i] == ',' || json[i] == ':' || json[i] == ']' || json[i] == '}' {
+			break
+		}
+	}
+	return append(buf, json[s:i]...), i, nl, true
+}
+
+// appendNotation appends the number in the notation. Numbers that cannot be
+// converted without losing their integer digits are appended as is.
+func appendNotation(buf, num []byte, notation NumberNotation) []byte {
+	f, err := strconv.ParseFloat(string(num), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) ||
+		(f >= 1<<53 || f <= -1<<53) && skipDigits(num, 1) == len(num) {
+		return append(buf, num...)
+	}
+	if notation == NotationScientific {
+		return strconv.AppendFloat(buf, f, 'e', -1, 64)
+	}
+	return strconv.AppendFloat(buf, f, 'f', -1, 64)
+}
+
+// normalizeSigns returns the number without a + sign, the - sign of a
+// zero, or the leading zeros of the integer part, for
+// Options.NormalizeSigns.
+func normalizeSigns(num []byte) []byte {
+	var sign byte
+	i := 0
+	if len(num) > 0 && (num[0] == '-' || num[0] == '+') {
+		sign = num[0]
+		i = 1
+	}
+	if i == len(num) || num[i] < '0' || num[i] > '9' {
+		// NaN and Inf
+		return num
+	}
+	j := i
+	for j+1 < len(num) && num[j] == '0' && num[j+1] >= '0' && num[j+1] <= '9' {
+		j++
+	}
+	if sign == '-' && !isZero(num) {
+		if j == i {
+			return num
+		}
+		return append([]byte{'-'}, num[j:]...)
+	}
+	return num[j:]
+}
+
+// appendGroupedDigits appends the number with thousands separators in the
+// integer part. The sign, fraction and exponent are left alone.
+func appendGroupedDigits(buf, num []byte) []byte {
+	var i int
+	if len(num) > 0 && (num[0] == '-' || num[0] == '+') {
+		buf = append(buf, num[0])
+		i = 1
+	}
+	j := i
+	for j < len(num) && num[j] >= '0' && num[j] <= '9' {
+		j++
+	}
+	for k := i; k < j; k++ {
+		if k > i && (j-k)%3 == 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, num[k])
+	}
+	return append(buf, num[j:]...)
+}
+
+// appendNewline appends a newline, without the spaces and tabs at the end
+// of the line when Options.TrimLineTrailingSpace is used. Returns the
+// position of the newline.
+func (st *prettyState) appendNewline(buf []byte) ([]byte, int) {
+	n := len(buf)
+	for st.opts.TrimLineTrailingSpace && n > 0 &&
+		(buf[n-1] == ' ' || buf[n-1] == '\t') {
+		n--
+	}
+	return append(buf[:n], '\n'), n
+}
+
+func appendTabs(buf []byte, prefix, indent string, tabs int) []byte {
+	if len(prefix) != 0 {
+		buf = append(buf, prefix...)
+	}
+	if len(indent) == 2 && indent[0] == ' ' && indent[1] == ' ' {
+		for i := 0; i < tabs; i++ {
+			buf = append(buf, ' ', ' ')
+		}
+	} else {
+		for i := 0; i < tabs; i++ {
+			buf = append(buf, indent...)
+		}
+	}
+	return buf
+}
+
+// appendTabs appends the Prefix and the indentation of a line at the
+// provided depth. With Options.IndentObject or Options.IndentArray, each
+// level is indented by the indent of the object or array at that level.
+func (st *prettyState) appendTabs(buf []byte, tabs int) []byte {
+	if st.kinds == nil {
+		return appendTabs(buf, st.opts.Prefix, st.opts.Indent, tabs)
+	}
+	buf = appendTabs(buf, st.opts.Prefix, st.opts.Indent, st.base)
+	for k := st.base; k < tabs && k-st.base < len(st.kinds); k++ {
+		indent := st.opts.IndentObject
+		if st.kinds[k-st.base] == '[' {
+			indent = st.opts.IndentArray
+		}
+		if indent == "" {
+			indent = st.opts.Indent
+		}
+		buf = append(buf, indent...)
+	}
+	return buf
+}
+
+// setKind sets the kind of the object or array that is at the depth of
+// tabs, for Options.IndentObject and Options.IndentArray. The kinds of the
+// deeper levels are cleared.
+func (st *prettyState) setKind(tabs int, open byte) {
+	if st.kinds != nil && tabs >= st.base {
+		st.kinds = append(st.kinds[:tabs-st.base], open)
+	}
+}
+
+// Style is the color style
+type Style struct {
+	Key, String, Number [2]string
+	True, False, Null   [2]string
+	Escape              [2]string
+	Brackets            [2]string
+	Append              func(dst []byte, c byte) []byte
+	// Glyphs, when set, replaces the brackets of objects and arrays.
+	Glyphs *BracketGlyphs
+	// EscapeWhitespace, when set, writes the tabs, newlines, carriage
+	// returns and vertical tabs inside of strings as the \t, \n, \r and
+	// \u000b escapes with the Escape colors, which keeps the layout of the
+	// terminal.
+	EscapeWhitespace bool
+	// EmptyString, Zero and FalseEmphasis, when set, are the colors of the
+	// "" strings, the numbers that are zero, such as 0 and -0.0, and the
+	// false values, which makes the unset values stand out. Keys are not
+	// changed. When not set, the String, Number and False colors are used.
+	EmptyString, Zero, FalseEmphasis [2]string
+	// ArrayCommas, when set, writes the commas of arrays with the Brackets
+	// colors, like the commas of objects. When not set, the commas of
+	// arrays are not colored.
+	ArrayCommas bool
+}
+
+// valueColor returns the color of the value v, which is the EmptyString,
+// Zero or FalseEmphasis color when v is such a value and the color is set,
+// otherwise the provided color.
+func (style *Style) valueColor(v []byte, color [2]string) [2]string {
+	switch {
+	case len(v) == 2 && v[0] == '"' && v[1] == '"':
+		if style.EmptyString != ([2]string{}) {
+			return style.EmptyString
+		}
+	case string(v) == "false":
+		if style.FalseEmphasis != ([2]string{}) {
+			return style.FalseEmphasis
+		}
+	case isZero(v):
+		if style.Zero != ([2]string{}) {
+			return style.Zero
+		}
+	}
+	return color
+}
+
+// BracketGlyphs are the text written in place of the { } [ ] brackets of
+// objects and arrays, such as ⟨ ⟩ and ⟦ ⟧. Each glyph should be a single
+// character wide. The output is only intended for display.
+type BracketGlyphs struct {
+	ObjectOpen, ObjectClose string
+	ArrayOpen, ArrayClose   string
+}
+
+// appendBracket appends the bracket, colon or comma c, using the glyph of
+// the bracket when there is one.
+func (style *Style) appendBracket(dst []byte, c byte, apnd func(dst []byte, c byte) []byte) []byte {
+	if style.Glyphs != nil {
+		var glyph string
+		switch c {
+		case '{':
+			glyph = style.Glyphs.ObjectOpen
+		case '}':
+			glyph = style.Glyphs.ObjectClose
+		case '[':
+			glyph = style.Glyphs.ArrayOpen
+		case ']':
+			glyph = style.Glyphs.ArrayClose
+		}
+		if glyph != "" {
+			return append(dst, glyph...)
+		}
+	}
+	return apnd(dst, c)
+}
+
+func hexp(p byte) byte {
+	switch {
+	case p < 10:
+		return p + '0'
+	default:
+		return (p - 10) + 'a'
+	}
+}
+
+// appendControlEscape appends the \u00XX escape of the control character.
+func appendControlEscape(dst []byte, c byte) []byte {
+	dst = append(dst, "\\u00"...)
+	dst = append(dst, hexp((c>>4)&0xF))
+	return append(dst, hexp((c)&0xF))
+}
+
+// SanitizeControls returns the formatted json with its raw control
+// characters written as \u00XX escapes, for displaying output that came
+// from json with control characters in its strings. The characters of the
+// strings are all escaped, and the newlines, tabs and carriage returns
+// between values are kept. Running it again does not change the result.
+func SanitizeControls(buf []byte) []byte {
+	out := make([]byte, 0, len(buf))
+	var str, esc bool
+	for _, c := range buf {
+		if c < ' ' || c == 0x7F {
+			if str || c != '\n' && c != '\t' && c != '\r' {
+				out = appendControlEscape(out, c)
+				esc = false
+				continue
+			}
+		}
+		out = append(out, c)
+		switch {
+		case esc:
+			esc = false
+		case str && c == '\\':
+			esc = true
+		case c == '"':
+			str = !str
+		}
+	}
+	return out
+}
+
+// DisplayWidth returns the number of terminal columns of s. East Asian
+// wide and fullwidth characters, and most emoji, are two columns. Combining
+// marks, zero width characters and control characters are zero columns,
+// and a tab is 8 columns. The bytes that are not UTF-8 are one column
+// each, like the replacement character. Terminal color codes are not
+// skipped.
+func DisplayWidth(s []byte) int {
+	return displayWidth(s, 8)
+}
+
+// displayWidth is like DisplayWidth with a tab of the provided number of
+// columns.
+func displayWidth(s []byte, tab int) int {
+	var w int
+	for i := 0; i < len(s); {
+		r, n := utf8.DecodeRune(s[i:])
+		if r == '\t' {
+			w += tab
+		} else {
+			w += runeWidth(r)
+		}
+		i += n
+	}
+	return w
+}
+
+// wideRunes are the ranges of the East Asian wide and fullwidth characters,
+// and of the emoji that are shown as two columns.
+var wideRunes = [][2]rune{
+	{0x1100, 0x115F}, {0x231A, 0x231B}, {0x2329, 0x232A}, {0x23E9, 0x23EC},
+	{0x23F0, 0x23F0}, {0x23F3, 0x23F3}, {0x25FD, 0x25FE}, {0x2614, 0x2615},
+	{0x2648, 0x2653}, {0x267F, 0x267F}, {0x2693, 0x2693}, {0x26A1, 0x26A1},
+	{0x26AA, 0x26AB}, {0x26BD, 0x26BE}, {0x26C4, 0x26C5}, {0x26CE, 0x26CE},
+	{0x26D4, 0x26D4}, {0x26EA, 0x26EA}, {0x26F2, 0x26F3}, {0x26F5, 0x26F5},
+	{0x26FA, 0x26FA}, {0x26FD, 0x26FD}, {0x2705, 0x2705}, {0x270A, 0x270B},
+	{0x2728, 0x2728}, {0x274C, 0x274C}, {0x274E, 0x274E}, {0x2753, 0x2755},
+	{0x2757, 0x2757}, {0x2795, 0x2797}, {0x27B0, 0x27B0}, {0x27BF, 0x27BF},
+	{0x2B1B, 0x2B1C}, {0x2B50, 0x2B50}, {0x2B55, 0x2B55}, {0x2E80, 0x303E},
+	{0x3041, 0x33FF}, {0x3400, 0x4DBF}, {0x4E00, 0x9FFF}, {0xA000, 0xA4CF},
+	{0xA960, 0xA97F}, {0xAC00, 0xD7A3}, {0xF900, 0xFAFF}, {0xFE10, 0xFE19},
+	{0xFE30, 0xFE6F}, {0xFF00, 0xFF60}, {0xFFE0, 0xFFE6}, {0x16FE0, 0x16FE4},
+	{0x17000, 0x18AFF}, {0x1B000, 0x1B2FF}, {0x1F004, 0x1F004},
+	{0x1F0CF, 0x1F0CF}, {0x1F18E, 0x1F18E}, {0x1F191, 0x1F19A},
+	{0x1F200, 0x1F251}, {0x1F300, 0x1F320}, {0x1F32D, 0x1F335},
+	{0x1F337, 0x1F37C}, {0x1F37E, 0x1F393}, {0x1F3A0, 0x1F3CA},
+	{0x1F3CF, 0x1F3D3}, {0x1F3E0, 0x1F3F0}, {0x1F3F4, 0x1F3F4},
+	{0x1F3F8, 0x1F3FA}, {0x1F400, 0x1F43E}, {0x1F440, 0x1F440},
+	{0x1F442, 0x1F4FC}, {0x1F4FF, 0x1F53D}, {0x1F54B, 0x1F54E},
+	{0x1F550, 0x1F567}, {0x1F57A, 0x1F57A}, {0x1F595, 0x1F596},
+	{0x1F5A4, 0x1F5A4}, {0x1F5FB, 0x1F64F}, {0x1F680, 0x1F6C5},
+	{0x1F6CC, 0x1F6CC}, {0x1F6D0, 0x1F6D2}, {0x1F6D5, 0x1F6D7},
+	{0x1F6EB, 0x1F6EC}, {0x1F6F4, 0x1F6FC}, {0x1F7E0, 0x1F7EB},
+	{0x1F90C, 0x1F93A}, {0x1F93C, 0x1F945}, {0x1F947, 0x1F9FF},
+	{0x1FA70, 0x1FAFF}, {0x20000, 0x2FFFD}, {0x30000, 0x3FFFD},
+}
+
+// runeWidth returns the number of terminal columns of r, for DisplayWidth.
+func runeWidth(r rune) int {
+	switch {
+	case r < ' ' || r >= 0x7F && r < 0xA0:
+		return 0
+	case r < 0x300:
+		return 1
+	case r >= 0x1160 && r <= 0x11FF, r == 0x200B, r >= 0x1F3FB && r <= 0x1F3FF,
+		unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		// combining marks, hangul vowels and finals, zero width spaces,
+		// joiners and emoji modifiers
+		return 0
+	}
+	i := sort.Search(len(wideRunes), func(i int) bool {
+		return wideRunes[i][1] >= r
+	})
+	if i < len(wideRunes) && wideRunes[i][0] <= r {
+		return 2
+	}
+	return 1
+}
+
+// EscapedString returns the string as a quoted json string.
+// See AppendEscapedString.
+func EscapedString(s string) []byte {
+	return AppendEscapedString(nil, s)
+}
+
+// AppendEscapedString appends the string to dst as a quoted json string.
+// Quotes, backslashes and control characters are escaped, and invalid UTF-8
+// is replaced with the Unicode replacement character. The U+2028 and U+2029
+// line separators are escaped for embedding in JavaScript.
+func AppendEscapedString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= ' ' && c < utf8.RuneSelf && c != '"' && c != '\\' {
+			dst = append(dst, c)
+			i++
+			continue
+		}
+		if c < utf8.RuneSelf {
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = appendControlEscape(dst, c)
+			}
+			i++
+			continue
+		}
+		r, n := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && n == 1:
+			dst = append(dst, "\\ufffd"...)
+		case r == '\u2028' || r == '\u2029':
+			dst = append(dst, "\\u202"...)
+			dst = append(dst, hexp(byte(r&0xF)))
+		default:
+			dst = append(dst, s[i:i+n]...)
+		}
+		i += n
+	}
+	return append(dst, '"')
+}
+
+// TerminalStyle is for terminals
+var TerminalStyle *Style
+
+// TerminalStyleDimPunct is like TerminalStyle, but with faint brackets,
+// commas and colons, including the commas of arrays, which is less noisy.
+var TerminalStyleDimPunct *Style
+
+func init() {
+	TerminalStyle = &Style{
+		Key:      [2]string{"\x1B[1m\x1B[94m", "\x1B[0m"},
+		String:   [2]string{"\x1B[32m", "\x1B[0m"},
+		Number:   [2]string{"\x1B[33m", "\x1B[0m"},
+		True:     [2]string{"\x1B[36m", "\x1B[0m"},
+		False:    [2]string{"\x1B[36m", "\x1B[0m"},
+		Null:     [2]string{"\x1B[2m", "\x1B[0m"},
+		Escape:   [2]string{"\x1B[35m", "\x1B[0m"},
+		Brackets: [2]string{"\x1B[1m", "\x1B[0m"},
+		Append: func(dst []byte, c byte) []byte {
+			if c < ' ' && (c != '\r' && c != '\n' && c != '\t' && c != '\v') {
+				return appendControlEscape(dst, c)
+			}
+			return append(dst, c)
+		},
+	}
+	dim := *TerminalStyle
+	dim.Brackets = [2]string{"\x1B[2m", "\x1B[0m"}
+	dim.ArrayCommas = true
+	TerminalStyleDimPunct = &dim
+}
+
+// appendColorString appends the string at position i of src with the key or
+// string style, and the escape style for escape sequences. Returns the
+// position just past the string.
+func appendColorString(dst, src []byte, i int, key bool, style *Style,
+	apnd func(dst []byte, c byte) []byte) ([]byte, int) {
+	color := style.String
+	if key {
+		color = style.Key
+	} else if i+1 < len(src) && src[i+1] == '"' {
+		color = style.valueColor(src[i:i+2], color)
+	}
+	dst = append(dst, color[0]...)
+	dst = apnd(dst, '"')
+	end := scanString(src, i)
+	esc := false
+	uesc := 0
+	for i = i + 1; i < len(src); i++ {
+		if esc {
+			dst = apnd(dst, src[i])
+			if uesc == 1 {
+				esc = false
+				dst = style.appendEscapeEnd(dst, color)
+			} else {
+				uesc--
+			}
+		} else if src[i] == '\\' {
+			dst = style.appendEscapeStart(dst, color)
+			dst = apnd(dst, src[i])
+			esc = true
+			if i+1 < len(src) && src[i+1] == 'u' {
+				uesc = 5
+			} else {
+				uesc = 1
+			}
+		} else if style.EscapeWhitespace && (src[i] == '\t' ||
+			src[i] == '\n' || src[i] == '\r' || src[i] == '\v') {
+			dst = style.appendEscapeStart(dst, color)
+			switch src[i] {
+			case '\t':
+				dst = append(dst, '\\', 't')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			default:
+				dst = appendControlEscape(dst, src[i])
+			}
+			dst = style.appendEscapeEnd(dst, color)
+		} else {
+			dst = apnd(dst, src[i])
+		}
+		if i == end-1 && src[i] == '"' {
+			break
+		}
+	}
+	if esc && style.Escape != ([2]string{}) {
+		dst = append(dst, style.Escape[1]...)
+	} else {
+		dst = append(dst, color[1]...)
+	}
+	if i < len(src) {
+		i++
+	}
+	return dst, i
+}
+
+// appendEscapeStart appends the end of the color of the string and the
+// start of the Escape color, when the Escape color is set. Otherwise the
+// escapes keep the color of the string.
+func (style *Style) appendEscapeStart(dst []byte, color [2]string) []byte {
+	if style.Escape == ([2]string{}) {
+		return dst
+	}
+	dst = append(dst, color[1]...)
+	return append(dst, style.Escape[0]...)
+}
+
+// appendEscapeEnd appends the end of the Escape color and the color of the
+// string, when the Escape color is set.
+func (style *Style) appendEscapeEnd(dst []byte, color [2]string) []byte {
+	if style.Escape == ([2]string{}) {
+		return dst
+	}
+	dst = append(dst, style.Escape[1]...)
+	return append(dst, color[0]...)
+}
+
+// styleAppend returns the Append function of the style.
+func styleAppend(style *Style) func(dst []byte, c byte) []byte {
+	if style.Append == nil {
+		return func(dst []byte, c byte) []byte {
+			return append(dst, c)
+		}
+	}
+	return style.Append
+}
+
+// Color will colorize the json. The style parma is used for customizing
+// the colors. Passing nil to the style param will use the default
+// TerminalStyle. The brackets, and the colons and commas of objects, are
+// written with the Brackets colors, as are the commas of arrays when the
+// style has ArrayCommas. Input that only has whitespace results in empty
+// output.
+func Color(src []byte, style *Style) []byte {
+	if isBlank(src) {
+		return []byte{}
+	}
+	return appendColor(nil, src, style, nil)
+}
+
+// ColorAppend is like Color but appends the colorized json to dst, which
+// allows for reusing the dst buffer when colorizing many small documents.
+func ColorAppend(dst, src []byte, style *Style) []byte {
+	if isBlank(src) {
+		return dst
+	}
+	return appendColor(dst, src, style, nil)
+}
+
+// ColorSemantic is like Color but the values of the keys in the rules are
+// colored with the style of their rule, such as for coloring the levels of
+// log records, where rules["level"]["error"] is the style of the "error"
+// values of the "level" keys. Strings are matched by their unescaped value
+// and other values by their json, such as "true" or "10". The base style is
+// used for everything else. Passing nil to the base param will use the
+// default TerminalStyle. Input that only has whitespace results in empty
+// output, like Color.
+func ColorSemantic(src []byte, rules map[string]map[string]*Style, base *Style) []byte {
+	if isBlank(src) {
+		return []byte{}
+	}
+	return appendColor(nil, src, base, rules)
+}
+
+// ColorKeysOnly is like Color but only the keys are colored, with the
+// keyStyle, such as [2]string{"\x1b[94m", "\x1b[0m"}. Nothing else is
+// changed, which is the same as Color with a Style that only has a Key.
+// Input that only has whitespace results in empty output, like Color.
+func ColorKeysOnly(src []byte, keyStyle [2]string) []byte {
+	if isBlank(src) {
+		return []byte{}
+	}
+	return appendColor(nil, src, &Style{Key: keyStyle}, nil)
+}
+
+// ansiReset resets all terminal colors and attributes.
+const ansiReset = "\x1B[0m"
+
+// ColorContinue appends the colorized json to dst, which may already
+// contain terminal color codes, such as a log line. A reset code is written
+// prior to and after the json to ensure that colors do not bleed between
+// dst and the json. Input that only has whitespace is not appended,
+// without the reset codes, like ColorAppend.
+func ColorContinue(dst, src []byte, style *Style) []byte {
+	if isBlank(src) {
+		return dst
+	}
+	dst = append(dst, ansiReset...)
+	dst = appendColor(dst, src, style, nil)
+	return append(dst, ansiReset...)
+}
+
+// ColorWriter is an io.Writer that colorizes newline delimited json, one
+// line at a time, and writes it to W. Each complete line is written as soon
+// as its newline arrives. A partial line is kept until the rest of it is
+// written, or until Flush. The lines that only have whitespace are written
+// empty, like Color.
+type ColorWriter struct {
+	W     io.Writer
+	Style *Style
+	line  []byte
+	out   []byte
+}
+
+// NewColorWriter returns a ColorWriter that writes to w using the style.
+func NewColorWriter(w io.Writer, style *Style) *ColorWriter {
+	return &ColorWriter{W: w, Style: style}
+}
+
+// Write colorizes and writes the complete lines of p.
+func (cw *ColorWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			cw.line = append(cw.line, p...)
+			break
+		}
+		line := p[:i]
+		if len(cw.line) > 0 {
+			cw.line = append(cw.line, line...)
+			line = cw.line
+		}
+		cw.out = cw.out[:0]
+		if !isBlank(line) {
+			cw.out = appendColor(cw.out, line, cw.Style, nil)
+		}
+		cw.out = append(cw.out, '\n')
+		cw.line = cw.line[:0]
+		if _, err := cw.W.Write(cw.out); err != nil {
+			return n - len(p), err
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Flush colorizes and writes the partial line, without a newline.
+func (cw *ColorWriter) Flush() error {
+	if isBlank(cw.line) {
+		cw.line = cw.line[:0]
+		return nil
+	}
+	cw.out = appendColor(cw.out[:0], cw.line, cw.Style, nil)
+	cw.line = cw.line[:0]
+	_, err := cw.W.Write(cw.out)
+	return err
+}
+
+// ColorLines colorizes the newline delimited json records of data and
+// writes them to w, one line at a time. The newlines are kept as is. A
+// final line without a newline is written last. Input that only has
+// whitespace results in empty output, like Color. See ColorWriter.
+func ColorLines(w io.Writer, data []byte, style *Style) error {
+	if isBlank(data) {
+		return nil
+	}
+	cw := NewColorWriter(w, style)
+	if _, err := cw.Write(data); err != nil {
+		return err
+	}
+	return cw.Flush()
+}
+
+// ColorReaderWriter colorizes the json that is read from r and writes it
+// to w as it is read, without reading all of r first. The output is the
+// same as Color. Strings are written as they arrive, which allows for very
+// large or unbounded input, such as a stream of many documents. Input that
+// only has whitespace results in empty output, like Color.
+func ColorReaderWriter(w io.Writer, r io.Reader, style *Style) error {
+	if style == nil {
+		style = TerminalStyle
+	}
+	cs := &colorStream{style: style, apnd: styleAppend(style)}
+	buf := make([]byte, 32*1024)
+	// lead is the whitespace at the start of the input, which is kept until
+	// the input is known to not be blank.
+	var out, lead []byte
+	blank := true
+	for {
+		n, err := r.Read(buf)
+		if blank && isBlank(buf[:n]) {
+			lead = append(lead, buf[:n]...)
+		} else if n > 0 {
+			out = out[:0]
+			if blank {
+				out = cs.write(out, lead, false)
+				blank = false
+			}
+			out = cs.write(out, buf[:n], false)
+			if _, werr := w.Write(out); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			out = cs.write(out[:0], nil, true)
+			_, err = w.Write(out)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// colorStream is the state of ColorReaderWriter, which is carried across
+// the reads. It colorizes like appendColor, but a string may be split
+// between reads. The scalar is kept until its end arrives.
+type colorStream struct {
+	style *Style
+	apnd  func(dst []byte, c byte) []byte
+	stack []colorFrame
+	// str is true inside of a string, which is colored by color. The esc
+	// is true inside of an escape, with uesc hex digits left to read, and
+	// slashes is the number of backslashes prior to the next byte.
+	str     bool
+	color   [2]string
+	esc     bool
+	uesc    int
+	slashes int
+	// open is true when the opening quote is not yet written, until it is
+	// known if the string is empty, for Style.EmptyString.
+	open bool
+	// scalar is the start of a number, true, false or null.
+	scalar []byte
+}
+
+// isZero returns true when the number is a zero, such as 0, -0.0 or 0e10.
+func isZero(num []byte) bool {
+	i := 0
+	if len(num) > 0 && (num[0] == '-' || num[0] == '+') {
+		i = 1
+	}
+	if i == len(num) || num[i] < '0' || num[i] > '9' {
+		return false
+	}
+	for ; i < len(num) && num[i] != 'e' && num[i] != 'E'; i++ {
+		if num[i] != '0' && num[i] != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// isScalarEnd returns true when c ends a number, true, false or null.
+func isScalarEnd(c byte) bool {
+	return c <= ' ' || c == ',' || c == ':' || c == ']' || c == '}'
+}
+
+// write appends the colorized src to dst. At the eof, the kept scalar and
+// an open string are completed.
+func (cs *colorStream) write(dst, src []byte, eof bool) []byte {
+	style, apnd := cs.style, cs.apnd
+	if len(cs.scalar) > 0 {
+		j := 0
+		for ; j < len(src) && !isScalarEnd(src[j]); j++ {
+		}
+		cs.scalar = append(cs.scalar, src[:j]...)
+		if j == len(src) && !eof {
+			return dst
+		}
+		dst = cs.appendScalar(dst, cs.scalar, j < len(src))
+		cs.scalar = cs.scalar[:0]
+		src = src[j:]
+	}
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		if cs.str {
+			dst = cs.appendStringByte(dst, c)
+			continue
+		}
+		switch {
+		case c == '"':
+			cs.color = style.String
+			if len(cs.stack) > 0 && cs.stack[len(cs.stack)-1].key {
+				cs.color = style.Key
+			} else if style.EmptyString != ([2]string{}) {
+				// the color is known at the next byte
+				cs.open = true
+			}
+			cs.str, cs.slashes = true, 0
+			if !cs.open {
+				dst = append(dst, cs.color[0]...)
+				dst = apnd(dst, c)
+			}
+		case c == '{' || c == '[':
+			cs.stack = append(cs.stack, colorFrame{c, c == '{'})
+			dst = append(dst, style.Brackets[0]...)
+			dst = style.appendBracket(dst, c, apnd)
+			dst = append(dst, style.Brackets[1]...)
+		case (c == '}' || c == ']') && len(cs.stack) > 0:
+			cs.stack = cs.stack[:len(cs.stack)-1]
+			dst = append(dst, style.Brackets[0]...)
+			dst = style.appendBracket(dst, c, apnd)
+			dst = append(dst, style.Brackets[1]...)
+		case (c == ':' || c == ',') && len(cs.stack) > 0 &&
+			(cs.stack[len(cs.stack)-1].kind == '{' || c == ',' && style.ArrayCommas):
+			if cs.stack[len(cs.stack)-1].kind == '{' {
+				cs.stack[len(cs.stack)-1].key = !cs.stack[len(cs.stack)-1].key
+			}
+			dst = append(dst, style.Brackets[0]...)
+			dst = apnd(dst, c)
+			dst = append(dst, style.Brackets[1]...)
+		case (c >= '0' && c <= '9') || c == '-' || c == 't' || c == 'f' ||
+			c == 'n' || isNaNOrInf(src[i:]):
+			j := i + 1
+			for ; j < len(src) && !isScalarEnd(src[j]); j++ {
+			}
+			if j == len(src) && !eof {
+				cs.scalar = append(cs.scalar, src[i:]...)
+				return dst
+			}
+			dst = cs.appendScalar(dst, src[i:j], j < len(src))
+			i = j - 1
+		default:
+			dst = apnd(dst, c)
+		}
+	}
+	if eof && cs.str {
+		if cs.open {
+			dst = append(dst, cs.color[0]...)
+			dst = apnd(dst, '"')
+			cs.open = false
+		}
+		if cs.esc && style.Escape != ([2]string{}) {
+			dst = append(dst, style.Escape[1]...)
+		} else {
+			dst = append(dst, cs.color[1]...)
+		}
+		cs.str, cs.esc = false, false
+	}
+	return dst
+}
+
+// appendScalar appends the number, true, false or null. The more is true
+// when the scalar is followed by other bytes.
+func (cs *colorStream) appendScalar(dst, scalar []byte, more bool) []byte {
+	if more && len(scalar) == 1 && scalar[0] == 'n' {
+		// a single n that is followed by other bytes is a nan to Color
+		dst = append(dst, cs.style.Number[0]...)
+		dst = cs.apnd(dst, 'n')
+		return append(dst, cs.style.Number[1]...)
+	}
+	return appendColor(dst, scalar, cs.style, nil)
+}
+
+// appendStringByte appends the byte c of a string, like appendColorString.
+func (cs *colorStream) appendStringByte(dst []byte, c byte) []byte {
+	if cs.open {
+		if c == '"' {
+			cs.color = cs.style.EmptyString
+		}
+		dst = append(dst, cs.color[0]...)
+		dst = cs.apnd(dst, '"')
+		cs.open = false
+	}
+	style, color := cs.style, cs.color
+	// a quote ends the string when it follows an even number of
+	// backslashes, even inside of an escape
+	end := c == '"' && cs.slashes%2 == 0
+	if c == '\\' {
+		cs.slashes++
+	} else {
+		cs.slashes = 0
+	}
+	switch {
+	case cs.esc:
+		dst = cs.apnd(dst, c)
+		if cs.uesc == -1 && c == 'u' {
+			cs.uesc = 4
+		} else if cs.uesc--; cs.uesc <= 0 {
+			cs.esc = false
+			dst = style.appendEscapeEnd(dst, color)
+		}
+		if end {
+			if cs.esc && style.Escape != ([2]string{}) {
+				dst = append(dst, style.Escape[1]...)
+			} else {
+				dst = append(dst, color[1]...)
+			}
+			cs.str, cs.esc = false, false
+		}
+	case c == '\\':
+		dst = style.appendEscapeStart(dst, color)
+		dst = cs.apnd(dst, c)
+		cs.esc, cs.uesc = true, -1
+	case end:
+		dst = cs.apnd(dst, c)
+		dst = append(dst, color[1]...)
+		cs.str = false
+	case style.EscapeWhitespace && (c == '\t' || c == '\n' || c == '\r' ||
+		c == '\v'):
+		dst = style.appendEscapeStart(dst, color)
+		switch c {
+		case '\t':
+			dst = append(dst, '\\', 't')
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		default:
+			dst = appendControlEscape(dst, c)
+		}
+		dst = style.appendEscapeEnd(dst, color)
+	default:
+		dst = cs.apnd(dst, c)
+	}
+	return dst
+}
+
+// ruleStyle returns the style of the rule for the value of the key, when
+// the value is a member of an object, otherwise the style.
+func ruleStyle(rules map[string]map[string]*Style, stack []colorFrame, key, value string, style *Style) *Style {
+	if len(stack) == 0 || stack[len(stack)-1].kind != '{' {
+		return style
+	}
+	if rule := rules[key][value]; rule != nil {
+		return rule
+	}
+	return style
+}
+
+// colorFrame is an open object or array of appendColor. The key is true
+// when the next string of an object is a key.
+type colorFrame struct {
+	kind byte
+	key  bool
+}
+
+// colorStacks are the reused stacks of appendColor.
+var colorStacks = sync.Pool{New: func() interface{} {
+	stack := make([]colorFrame, 0, 16)
+	return &stack
+}}
+
+func appendColor(dst, src []byte, style *Style, rules map[string]map[string]*Style) []byte {
+	if style == nil {
+		style = TerminalStyle
+	}
+	// key is the last unescaped key, for the rules
+	var key string
+	apnd := styleAppend(style)
+	sp := colorStacks.Get().(*[]colorFrame)
+	stack := (*sp)[:0]
+	defer func() {
+		*sp = stack[:0]
+		colorStacks.Put(sp)
+	}()
+	for i := 0; i < len(src); i++ {
+		if src[i] == '"' {
+			iskey := len(stack) > 0 && stack[len(stack)-1].key
+			end := valueEnd(src, i)
+			vstyle := style
+			if rules != nil {
+				// copy the string, which keeps src from escaping
+				str := string(parsestr([]byte(string(src[i:end]))))
+				if iskey {
+					key = str
+				} else {
+					vstyle = ruleStyle(rules, stack, key, str, style)
+				}
+			}
+			dst, end = appendColorString(dst, src, i, iskey, vstyle, apnd)
+			i = end - 1
+		} else if src[i] == '{' || src[i] == '[' {
+			stack = append(stack, colorFrame{src[i], src[i] == '{'})
+			dst = append(dst, style.Brackets[0]...)
+			dst = style.appendBracket(dst, src[i], apnd)
+			dst = append(dst, style.Brackets[1]...)
+		} else if (src[i] == '}' || src[i] == ']') && len(stack) > 0 {
+			stack = stack[:len(stack)-1]
+			dst = append(dst, style.Brackets[0]...)
+			dst = style.appendBracket(dst, src[i], apnd)
+			dst = append(dst, style.Brackets[1]...)
+		} else if (src[i] == ':' || src[i] == ',') && len(stack) > 0 &&
+			(stack[len(stack)-1].kind == '{' || src[i] == ',' && style.ArrayCommas) {
+			if stack[len(stack)-1].kind == '{' {
+				stack[len(stack)-1].key = !stack[len(stack)-1].key
+			}
+			dst = append(dst, style.Brackets[0]...)
+			dst = apnd(dst, src[i])
+			dst = append(dst, style.Brackets[1]...)
+		} else {
+			vstyle := style
+			if rules != nil {
+				vstyle = ruleStyle(rules, stack, key, string(src[i:valueEnd(src, i)]), style)
+			}
+			var color [2]string
+			if (src[i] >= '0' && src[i] <= '9') || src[i] == '-' || isNaNOrInf(src[i:]) {
+				color = vstyle.Number
+			} else if src[i] == 't' {
+				color = vstyle.True
+			} else if src[i] == 'f' {
+				color = vstyle.False
+			} else if src[i] == 'n' {
+				color = vstyle.Null
+			} else {
+				dst = apnd(dst, src[i])
+				continue
+			}
+			j := i
+			for ; j < len(src) && !isScalarEnd(src[j]); j++ {
+			}
+			color = vstyle.valueColor(src[i:j], color)
+			dst = append(dst, color[0]...)
+			for ; i < j; i++ {
+				dst = apnd(dst, src[i])
+			}
+			i--
+			dst = append(dst, color[1]...)
+		}
+	}
+	return dst
+}
+
+// Spec strips out comments and trailing commas and convert the input to a
+// valid JSON per the official spec: https://tools.ietf.org/html/rfc8259
+//
+// The resulting JSON will always be the same length as the input and it will
+// include all of the same line breaks at matching offsets. This is to ensure
+// the result can be later processed by a external parser and that that
+// parser will report messages or errors with the correct offsets. The only
+// exception is input that only has whitespace, which results in empty output,
+// like Pretty, Ugly and Color.
+func Spec(src []byte) []byte {
+	if isBlank(src) {
+		return []byte{}
+	}
+	return spec(src, nil)
+}
+
+// SpecInPlace is the same as Spec, but this method reuses the input json
+// buffer to avoid allocations. Do not use the original bytes slice upon return.
+func SpecInPlace(src []byte) []byte {
+	if isBlank(src) {
+		return src[:0]
+	}
+	return spec(src, src)
+}
+
+// isBlank returns true when the json is empty or only has whitespace.
+func isBlank(json []byte) bool {
+	for _, c := range json {
+		if c > ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+func spec(src, dst []byte) []byte {
+	dst = dst[:0]
+	for i := 0; i < len(src); i++ {
+		if src[i] == '/' {
+			if i < len(src)-1 {
+				if src[i+1] == '/' {
+					dst = append(dst, ' ', ' ')
+					i += 2
+					for ; i < len(src); i++ {
+						if src[i] == '\n' {
+							dst = append(dst, '\n')
+							break
+						} else if src[i] == '\t' || src[i] == '\r' {
+							dst = append(dst, src[i])
 						} else {
-							dst = append(dst, style.String[0]...)
+							dst = append(dst, ' ')
 						}
-					} else {
-						uesc--
 					}
-				} else {
-					dst = apnd(dst, src[i])
+					continue
 				}
-				if src[i] == '"' {
-					j := i - 1
-					for ; ; j-- {
-						if src[j] != '\\' {
+				if src[i+1] == '*' {
+					dst = append(dst, ' ', ' ')
+					i += 2
+					for ; i < len(src)-1; i++ {
+						if src[i] == '*' && src[i+1] == '/' {
+							dst = append(dst, ' ', ' ')
+							i++
 							break
+						} else if src[i] == '\n' || src[i] == '\t' ||
+							src[i] == '\r' {
+							dst = append(dst, src[i])
+						} else {
+							dst = append(dst, ' ')
 						}
 					}
-					if (j-i)%2 != 0 {
-						break
-					}
+					continue
+				}
+			}
+		}
+		dst = append(dst, src[i])
+		if src[i] == '"' {
+			end := scanString(src, i)
+			dst = append(dst, src[i+1:end]...)
+			i = end - 1
+		} else if src[i] == '}' || src[i] == ']' {
+			for j := len(dst) - 2; j >= 0; j-- {
+				if dst[j] <= ' ' {
+					continue
+				}
+				if dst[j] == ',' {
+					dst[j] = ' '
+				}
+				break
+			}
+		}
+	}
+	return dst
+}
+
+// ValueAtPointer returns the raw bytes of the value at the provided RFC 6901
+// JSON Pointer, such as "/user/addresses/0/city". The empty pointer refers to
+// the whole document. Returns false when the pointer does not resolve.
+func ValueAtPointer(json []byte, pointer string) ([]byte, bool) {
+	if len(pointer) > 0 && pointer[0] != '/' {
+		return nil, false
+	}
+	i := skipSpace(json, 0)
+	for len(pointer) > 0 {
+		pointer = pointer[1:]
+		tok := pointer
+		if j := strings.IndexByte(pointer, '/'); j != -1 {
+			tok, pointer = pointer[:j], pointer[j:]
+		} else {
+			pointer = ""
+		}
+		if strings.IndexByte(tok, '~') != -1 {
+			tok = strings.Replace(tok, "~1", "/", -1)
+			tok = strings.Replace(tok, "~0", "~", -1)
+		}
+		var ok bool
+		if i, ok = childAt(json, i, tok); !ok {
+			return nil, false
+		}
+	}
+	if i >= len(json) {
+		return nil, false
+	}
+	return json[i:valueEnd(json, i)], true
+}
+
+// childAt returns the position of the child value named by a JSON Pointer
+// reference token, for the object or array at position i.
+func childAt(json []byte, i int, tok string) (int, bool) {
+	if i >= len(json) || (json[i] != '{' && json[i] != '[') {
+		return i, false
+	}
+	index := -1
+	if json[i] == '[' {
+		if len(tok) == 0 || (len(tok) > 1 && tok[0] == '0') {
+			return i, false
+		}
+		n, err := strconv.Atoi(tok)
+		if err != nil || n < 0 || tok[0] == '+' {
+			return i, false
+		}
+		index = n
+	}
+	open := json[i]
+	for n := 0; ; n++ {
+		i = skipSpace(json, i+1)
+		if i >= len(json) || json[i] == '}' || json[i] == ']' {
+			return i, false
+		}
+		match := n == index
+		if open == '{' {
+			if json[i] != '"' {
+				return i, false
+			}
+			end := valueEnd(json, i)
+			match = string(parsestr(json[i:end])) == tok
+			i = skipSpace(json, end)
+			if i >= len(json) || json[i] != ':' {
+				return i, false
+			}
+			i = skipSpace(json, i+1)
+		}
+		if match {
+			return i, i < len(json)
+		}
+		i = skipSpace(json, valueEnd(json, i))
+		if i >= len(json) || json[i] != ',' {
+			return i, false
+		}
+	}
+}
+
+// Merge deep merges the override json document into the base document and
+// returns the pretty result. The members of objects in both documents are
+// merged, with the members of the override that are not in the base added
+// last. Any other value of the override, including arrays, replaces the
+// base value as a whole, since there is not yet an option for merging
+// arrays. The values are copied as is, so numbers keep their formatting.
+func Merge(base, override []byte, opts *Options) []byte {
+	return PrettyOptions(appendMerged(nil, base, override), opts)
+}
+
+func appendMerged(dst, base, override []byte) []byte {
+	i, j := skipSpace(base, 0), skipSpace(override, 0)
+	if j == len(override) {
+		return append(dst, base[i:valueEnd(base, i)]...)
+	}
+	if i == len(base) || base[i] != '{' || override[j] != '{' {
+		return append(dst, override[j:valueEnd(override, j)]...)
+	}
+	bmembers := objectMembers(base, i)
+	omembers := objectMembers(override, j)
+	used := make([]bool, len(omembers))
+	dst = append(dst, '{')
+	for n, bm := range bmembers {
+		if n > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, bm.key...)
+		dst = append(dst, ':')
+		value := bm.value
+		for k, om := range omembers {
+			if om.name == bm.name {
+				value = appendMerged(nil, value, om.value)
+				used[k] = true
+			}
+		}
+		dst = append(dst, value...)
+	}
+	for k, om := range omembers {
+		if !used[k] {
+			if len(dst) > 1 {
+				dst = append(dst, ',')
+			}
+			dst = append(dst, om.key...)
+			dst = append(dst, ':')
+			dst = append(dst, om.value...)
+		}
+	}
+	return append(dst, '}')
+}
+
+// Equal returns true when the json documents are semantically equal, with
+// the keys of objects in any order, any whitespace, any escaping of strings
+// and numbers of equal value, such as 1.0 and 1e0, or 1e20 and
+// 100000000000000000000. The numbers are compared exactly, by their
+// decimal digits, without rounding them to floats. See EqualOptions.
+func Equal(a, b []byte) bool {
+	return EqualOptions(a, b, false)
+}
+
+// EqualOptions is like Equal but, when strictNumbers is true, numbers are
+// only equal when they are written the same way. When a key appears more
+// than once in an object, the last member is used, like most parsers do.
+func EqualOptions(a, b []byte, strictNumbers bool) bool {
+	return bytes.Equal(appendCanonical(nil, a, strictNumbers),
+		appendCanonical(nil, b, strictNumbers))
+}
+
+// appendChecksum appends the // sha256:<hex> comment of the canonical form
+// of the json, for Options.ChecksumComment.
+func appendChecksum(buf, json []byte) []byte {
+	sum := sha256.Sum256(appendCanonical(nil, Spec(json), false))
+	buf = append(buf, "// sha256:"...)
+	return append(buf, hex.EncodeToString(sum[:])...)
+}
+
+// VerifyChecksum returns true when the json ends with the // sha256:<hex>
+// comment of Options.ChecksumComment and the checksum matches the
+// document, which is false when a value has been changed since.
+func VerifyChecksum(json []byte) bool {
+	i := bytes.LastIndex(json, []byte("// sha256:"))
+	if i == -1 {
+		return false
+	}
+	comment := bytes.TrimRight(json[i:], " \t\r\n")
+	start := headerEnd(json)
+	if start > i {
+		return false
+	}
+	return bytes.Equal(comment, appendChecksum(nil, json[start:]))
+}
+
+// appendCanonical appends the json with sorted keys and without
+// whitespace, where the strings are escaped the same way and, unless
+// strictNumbers, the numbers are in the form of appendCanonicalNumber.
+func appendCanonical(dst, json []byte, strictNumbers bool) []byte {
+	i := skipSpace(json, 0)
+	if i == len(json) {
+		return dst
+	}
+	v := json[i:valueEnd(json, i)]
+	switch json[i] {
+	case '{':
+		members := objectMembers(json, i)
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].name < members[j].name
+		})
+		dst = append(dst, '{')
+		for n, m := range members {
+			if n+1 < len(members) && members[n+1].name == m.name {
+				// the last member of the key is used
+				continue
+			}
+			if dst[len(dst)-1] != '{' {
+				dst = append(dst, ',')
+			}
+			dst = AppendEscapedString(dst, m.name)
+			dst = append(dst, ':')
+			dst = appendCanonical(dst, m.value, strictNumbers)
+		}
+		return append(dst, '}')
+	case '[':
+		dst = append(dst, '[')
+		for i = skipSpace(json, i+1); i < len(json) && json[i] != ']'; {
+			if dst[len(dst)-1] != '[' {
+				dst = append(dst, ',')
+			}
+			end := valueEnd(json, i)
+			if end == i {
+				break
+			}
+			dst = appendCanonical(dst, json[i:end], strictNumbers)
+			if i = skipSpace(json, end); i < len(json) && json[i] == ',' {
+				i = skipSpace(json, i+1)
+			}
+		}
+		return append(dst, ']')
+	case '"':
+		return AppendEscapedString(dst, string(parsestr(v)))
+	}
+	if getjtype(v) == jnumber && !strictNumbers {
+		return appendCanonicalNumber(dst, v)
+	}
+	return append(dst, v...)
+}
+
+// appendCanonicalNumber appends the number in scientific notation with one
+// digit before the point and without trailing zeros, such as 1.5e1 for 15
+// or 15.00, so that numbers of equal value are written the same way. A
+// zero is 0, without a sign. The digits are not rounded. Numbers that are
+// not in the json syntax, such as NaN, or with exponents that are too
+// large, are appended as is.
+func appendCanonicalNumber(dst, num []byte) []byte {
+	i := 0
+	neg := false
+	if i < len(num) && (num[i] == '-' || num[i] == '+') {
+		neg = num[i] == '-'
+		i++
+	}
+	j := skipDigits(num, i)
+	if j == i {
+		return append(dst, num...)
+	}
+	digits := append([]byte(nil), num[i:j]...)
+	var exp int64
+	if j < len(num) && num[j] == '.' {
+		k := skipDigits(num, j+1)
+		digits = append(digits, num[j+1:k]...)
+		exp -= int64(k - j - 1)
+		j = k
+	}
+	if j < len(num) && (num[j] == 'e' || num[j] == 'E') {
+		k := j + 1
+		if k < len(num) && (num[k] == '-' || num[k] == '+') {
+			k++
+		}
+		l := skipDigits(num, k)
+		if l == k || l-k > 15 {
+			return append(dst, num...)
+		}
+		e, _ := strconv.ParseInt(string(num[j+1:l]), 10, 64)
+		exp += e
+		j = l
+	}
+	if j != len(num) {
+		return append(dst, num...)
+	}
+	for len(digits) > 0 && digits[0] == '0' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return append(dst, '0')
+	}
+	for digits[len(digits)-1] == '0' {
+		digits = digits[:len(digits)-1]
+		exp++
+	}
+	if neg {
+		dst = append(dst, '-')
+	}
+	dst = append(dst, digits[0])
+	if len(digits) > 1 {
+		dst = append(dst, '.')
+		dst = append(dst, digits[1:]...)
+	}
+	dst = append(dst, 'e')
+	return strconv.AppendInt(dst, exp+int64(len(digits)-1), 10)
+}
+
+type member struct {
+	key   []byte // raw key, including the quotes
+	name  string // unescaped key
+	value []byte
+}
+
+// objectMembers returns the members of the object at position i.
+func objectMembers(json []byte, i int) []member {
+	var members []member
+	for i = skipSpace(json, i+1); i < len(json) && json[i] == '"'; {
+		var m member
+		end := valueEnd(json, i)
+		m.key = json[i:end]
+		m.name = string(parsestr(m.key))
+		i = skipSpace(json, end)
+		if i >= len(json) || json[i] != ':' {
+			break
+		}
+		i = skipSpace(json, i+1)
+		end = valueEnd(json, i)
+		m.value = json[i:end]
+		members = append(members, m)
+		if i = skipSpace(json, end); i < len(json) && json[i] == ',' {
+			i = skipSpace(json, i+1)
+		}
+	}
+	return members
+}
+
+// Statistics are the counts of the nodes in a json document.
+type Statistics struct {
+	Objects  int // number of objects
+	Arrays   int // number of arrays
+	Keys     int // number of object keys
+	Strings  int // number of string values, not including keys
+	Numbers  int // number of numbers
+	Booleans int // number of true and false values
+	Nulls    int // number of null values
+	MaxDepth int // deepest nesting of objects and arrays
+}
+
+// Stats returns the counts of the objects, arrays, keys and values in the
+// json document, and the maximum depth, in a single pass.
+func Stats(json []byte) Statistics {
+	var stats Statistics
+	walkJSON(json, func(kind TokenKind, start, end, depth int) {
+		switch kind {
+		case TokenObject, TokenArray:
+			if json[start] == '}' || json[start] == ']' {
+				return
+			}
+			if kind == TokenObject {
+				stats.Objects++
+			} else {
+				stats.Arrays++
+			}
+			if depth+1 > stats.MaxDepth {
+				stats.MaxDepth = depth + 1
+			}
+		case TokenKey:
+			stats.Keys++
+		case TokenString:
+			stats.Strings++
+		case TokenNumber:
+			stats.Numbers++
+		case TokenTrue, TokenFalse:
+			stats.Booleans++
+		case TokenNull:
+			stats.Nulls++
+		}
+	})
+	return stats
+}
+
+// InvalidUTF8Strings returns the offsets of the keys and string values
+// that contain invalid UTF-8, such as raw bytes of another encoding.
+func InvalidUTF8Strings(json []byte) []int {
+	var offsets []int
+	walkJSON(json, func(kind TokenKind, start, end, depth int) {
+		if (kind == TokenKey || kind == TokenString) && !utf8.Valid(json[start:end]) {
+			offsets = append(offsets, start)
+		}
+	})
+	return offsets
+}
+
+// FirstDuplicateKey returns the first key that appears more than once in
+// the same object of the json document, and the offset of its second
+// appearance. Keys are compared after unescaping, so "a" and "\u0061" are
+// the same key. The scan stops at the first duplicate, such as for a
+// linter that only needs a location to point at. The offset is -1 when
+// there are no duplicates.
+func FirstDuplicateKey(json []byte) (key string, offset int, ok bool) {
+	// seen are the keys of the open objects, nil for the open arrays
+	var seen []map[string]bool
+	var isKey bool
+	for i := 0; i < len(json); i++ {
+		switch json[i] {
+		case '{', '[':
+			var keys map[string]bool
+			if json[i] == '{' {
+				keys = make(map[string]bool)
+			}
+			seen = append(seen, keys)
+			isKey = keys != nil
+		case '}', ']':
+			if len(seen) > 0 {
+				seen = seen[:len(seen)-1]
+			}
+			isKey = false
+		case ',':
+			isKey = len(seen) > 0 && seen[len(seen)-1] != nil
+		case '"':
+			end := scanString(json, i)
+			if isKey {
+				name := string(parsestr(json[i:end]))
+				if seen[len(seen)-1][name] {
+					return name, i, true
+				}
+				seen[len(seen)-1][name] = true
+				isKey = false
+			}
+			i = end - 1
+		}
+	}
+	return "", -1, false
+}
+
+// Strings returns the unescaped string values of the json document in
+// document order, such as for full-text indexing. The keys are included
+// when includeKeys is true.
+func Strings(json []byte, includeKeys bool) []string {
+	var strs []string
+	walkJSON(json, func(kind TokenKind, start, end, depth int) {
+		if kind == TokenString || kind == TokenKey && includeKeys {
+			strs = append(strs, string(parsestr(json[start:end])))
+		}
+	})
+	return strs
+}
+
+// KeyTree returns the json with each string, number, boolean and null
+// replaced by the name of its type, which leaves only the keys of the
+// objects and the shape of the arrays. For example, {"a":{"b":1},"c":[2]}
+// becomes {"a":{"b":"number"},"c":["number"]}. The keys are sorted, which
+// allows for comparing the schemas of two documents.
+func KeyTree(json []byte) []byte {
+	buf := make([]byte, 0, len(json))
+	// comma is true when the next member is prior to a comma
+	var comma bool
+	walkJSON(json, func(kind TokenKind, start, end, depth int) {
+		c := json[start]
+		if comma && depth > 0 && c != '}' && c != ']' {
+			buf = append(buf, ',')
+		}
+		switch {
+		case kind == TokenKey:
+			buf = append(buf, json[start:end]...)
+			buf = append(buf, ':')
+			comma = false
+		case c == '{' || c == '[':
+			buf = append(buf, c)
+			comma = false
+		case c == '}' || c == ']':
+			buf = append(buf, c)
+			comma = true
+		default:
+			buf = append(buf, '"')
+			buf = append(buf, typeName(json[start:end])...)
+			buf = append(buf, '"')
+			comma = true
+		}
+	})
+	return Ugly(PrettyOptions(buf, &Options{SortKeys: true}))
+}
+
+// envFrame is an open object or array of EnvStyle. The base is the length
+// of the name of the object or array, n is the number of its members.
+type envFrame struct {
+	kind    byte
+	base, n int
+}
+
+// EnvStyle returns the members of the json object as KEY=value lines, such
+// as for a .env file. The members of nested objects and the elements of
+// arrays are written with their names joined by underscores, such as
+// DB_HOST=localhost for {"db":{"host":"localhost"}} and TAGS_0=a for
+// {"tags":["a"]}. Empty objects and arrays are written as '{}' and '[]'.
+// The characters of the keys that are not letters, digits or underscores
+// are written as underscores, and the keys are uppercased when
+// UppercaseKeys is used. Strings are unescaped and written bare when they
+// only have safe characters, otherwise in double quotes, and null is
+// written as an empty value. The lines are sorted by key when SortKeys is
+// used, otherwise they are in the order of the json.
+func EnvStyle(json []byte, opts *Options) []byte {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	var lines [][2][]byte
+	var name []byte
+	var stack []envFrame
+	// member starts the name of the next member, for its key or index
+	member := func(key []byte) {
+		top := &stack[len(stack)-1]
+		name = name[:top.base]
+		if top.base > 0 {
+			name = append(name, '_')
+		}
+		if key == nil {
+			name = strconv.AppendInt(name, int64(top.n), 10)
+		}
+		for _, c := range key {
+			if c >= 'a' && c <= 'z' && opts.UppercaseKeys {
+				c -= 'a' - 'A'
+			} else if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '_') {
+				c = '_'
+			}
+			name = append(name, c)
+		}
+		top.n++
+	}
+	line := func(value []byte) {
+		lines = append(lines, [2][]byte{append([]byte(nil), name...), value})
+	}
+	walkJSON(json, func(kind TokenKind, start, end, depth int) {
+		c := json[start]
+		if kind == TokenKey {
+			if len(stack) > 0 {
+				member(parsestr(json[start:end]))
+			}
+			return
+		}
+		if c == '}' || c == ']' {
+			if len(stack) == 0 {
+				return
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			name = name[:top.base]
+			if top.n == 0 && top.base > 0 {
+				line([]byte{'\'', top.kind, c, '\''})
+			}
+			return
+		}
+		if len(stack) > 0 && stack[len(stack)-1].kind == '[' {
+			member(nil)
+		}
+		if c == '{' || c == '[' {
+			stack = append(stack, envFrame{kind: c, base: len(name)})
+			return
+		}
+		if len(stack) == 0 {
+			// a value that is not in an object
+			return
+		}
+		var value []byte
+		switch kind {
+		case TokenString:
+			value = appendEnvValue(nil, parsestr(json[start:end]))
+		case TokenNull:
+		default:
+			value = json[start:end]
+		}
+		line(value)
+	})
+	if opts.SortKeys {
+		sort.SliceStable(lines, func(i, j int) bool {
+			return bytes.Compare(lines[i][0], lines[j][0]) < 0
+		})
+	}
+	var buf []byte
+	for _, l := range lines {
+		buf = append(buf, l[0]...)
+		buf = append(buf, '=')
+		buf = append(buf, l[1]...)
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+// appendEnvValue appends the string for EnvStyle, in double quotes with
+// the ", \\, $ and ` characters and the newlines escaped, unless it only has
+// safe characters.
+func appendEnvValue(buf, str []byte) []byte {
+	safe := len(str) > 0
+	for _, c := range str {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || strings.IndexByte("_-./:@%+,", c) != -1) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return append(buf, str...)
+	}
+	buf = append(buf, '"')
+	for _, c := range str {
+		switch c {
+		case '"', '\\', '$', '`':
+			buf = append(buf, '\\', c)
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"')
+}
+
+// walkJSON calls fn for each key, value, object and array in the json
+// document. Objects and arrays are visited twice, once for the opening and
+// once for the closing bracket. The depth is the number of containers that
+// enclose the token.
+func walkJSON(json []byte, fn func(kind TokenKind, start, end, depth int)) {
+	var stack []byte
+	var key bool
+	for i := 0; i < len(json); i++ {
+		switch json[i] {
+		case ' ', '\t', '\n', '\r', ':':
+		case ',':
+			key = len(stack) > 0 && stack[len(stack)-1] == '{'
+		case '{', '[':
+			kind := TokenArray
+			if json[i] == '{' {
+				kind = TokenObject
+			}
+			fn(kind, i, i+1, len(stack))
+			stack = append(stack, json[i])
+			key = json[i] == '{'
+		case '}', ']':
+			kind := TokenArray
+			if json[i] == '}' {
+				kind = TokenObject
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			fn(kind, i, i+1, len(stack))
+			key = false
+		default:
+			end := valueEnd(json, i)
+			if end == i {
+				continue
+			}
+			var kind TokenKind
+			switch json[i] {
+			case '"':
+				kind = TokenString
+				if key {
+					kind = TokenKey
+				}
+			case 't':
+				kind = TokenTrue
+			case 'f':
+				kind = TokenFalse
+			case 'n':
+				kind = TokenNull
+				if isNaNOrInf(json[i:]) {
+					kind = TokenNumber
+				}
+			default:
+				kind = TokenNumber
+			}
+			fn(kind, i, end, len(stack))
+			key = false
+			i = end - 1
+		}
+	}
+}
+
+// skipSpace returns the position of the next non-whitespace character.
+func skipSpace(json []byte, i int) int {
+	for ; i < len(json); i++ {
+		if json[i] > ' ' {
+			break
+		}
+	}
+	return i
+}
+
+// valueEnd returns the position just past the value at position i.
+func valueEnd(json []byte, i int) int {
+	if i >= len(json) {
+		return i
+	}
+	switch json[i] {
+	case '"':
+		return scanString(json, i)
+	case '{', '[':
+		var depth int
+		for ; i < len(json); i++ {
+			switch json[i] {
+			case '"':
+				i = valueEnd(json, i) - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return len(json)
+	}
+	for ; i < len(json); i++ {
+		if json[i] <= ' ' || json[i] == ',' || json[i] == ':' ||
+			json[i] == ']' || json[i] == '}' {
+			break
+		}
+	}
+	return i
+}
+
+// arrayNulls converts the null elements of the arrays of the json, for
+// Options.ArrayNullMode. The comma that follows a dropped element is
+// dropped too. The spans are the "" of NullEmpty, and the parts of the
+// json that follow the converted nulls.
+func arrayNulls(json []byte, mode ArrayNullMode) ([]byte, []srcSpan) {
+	buf := make([]byte, 0, len(json))
+	var spans []srcSpan
+	var stack []bool // true for arrays
+	for i := 0; i < len(json); i++ {
+		if json[i] <= ' ' || json[i] == ',' || json[i] == ':' {
+			buf = append(buf, json[i])
+			continue
+		}
+		if isComment(json, i) {
+			end := commentEnd(json, i)
+			buf = append(buf, json[i:end]...)
+			i = end - 1
+			continue
+		}
+		switch json[i] {
+		case '[', '{':
+			buf = append(buf, json[i])
+			stack = append(stack, json[i] == '[')
+		case ']', '}':
+			buf = append(buf, json[i])
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		default:
+			end := valueEnd(json, i)
+			if len(stack) == 0 || !stack[len(stack)-1] ||
+				string(json[i:end]) != "null" {
+				buf = append(buf, json[i:end]...)
+			} else {
+				if mode == NullEmpty {
+					spans = append(spans, srcSpan{len(buf), i, true})
+					buf = append(buf, '"', '"')
+				} else if j := skipSpace(json, end); j < len(json) && json[j] == ',' {
+					end = j + 1
 				}
+				spans = append(spans, srcSpan{len(buf), end, false})
+			}
+			i = end - 1
+		}
+	}
+	return buf, spans
+}
+
+// arraysToObjects converts the arrays of the json to objects that are keyed
+// by the index of each element, for Options.ArraysAsObjects. The spans are
+// the inserted keys, and the parts of the json that follow them.
+func arraysToObjects(json []byte) ([]byte, []srcSpan) {
+	buf := make([]byte, 0, len(json)+len(json)/2)
+	var spans []srcSpan
+	var stack []int // the next index of each array, or -1 for objects
+	for i := 0; i < len(json); i++ {
+		if json[i] <= ' ' || json[i] == ',' || json[i] == ':' {
+			buf = append(buf, json[i])
+			continue
+		}
+		if isComment(json, i) {
+			end := commentEnd(json, i)
+			buf = append(buf, json[i:end]...)
+			i = end - 1
+			continue
+		}
+		if len(stack) > 0 && stack[len(stack)-1] >= 0 && json[i] != ']' {
+			spans = append(spans, srcSpan{len(buf), i, true})
+			buf = append(buf, '"')
+			buf = strconv.AppendInt(buf, int64(stack[len(stack)-1]), 10)
+			buf = append(buf, '"', ':')
+			spans = append(spans, srcSpan{len(buf), i, false})
+			stack[len(stack)-1]++
+		}
+		switch json[i] {
+		case '[':
+			buf = append(buf, '{')
+			stack = append(stack, 0)
+		case '{':
+			buf = append(buf, '{')
+			stack = append(stack, -1)
+		case ']', '}':
+			buf = append(buf, '}')
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		default:
+			end := valueEnd(json, i)
+			buf = append(buf, json[i:end]...)
+			i = end - 1
+		}
+	}
+	return buf, spans
+}
+
+// srcSpan is where a part of a converted input starts, at dst of the
+// converted input and at src of the input. The inserted parts, like the
+// keys of ArraysAsObjects, are not in the input, and are at the offset of
+// the input that follows them.
+type srcSpan struct {
+	dst, src int
+	inserted bool
+}
+
+// inputOffset returns the input offset of the offset i of the converted
+// input, which are the same prior to the first span.
+func inputOffset(spans []srcSpan, i int) (int, bool) {
+	n := sort.Search(len(spans), func(n int) bool { return spans[n].dst > i }) - 1
+	if n < 0 {
+		return i, false
+	}
+	if spans[n].inserted {
+		return spans[n].src, true
+	}
+	return spans[n].src + i - spans[n].dst, false
+}
+
+// addConv adds the spans of a conversion of the input, which was of the
+// input past the start.
+func (st *prettyState) addConv(spans []srcSpan, start int) {
+	for n := range spans {
+		spans[n].dst += start
+		spans[n].src += start
+	}
+	st.convs = append(st.convs, spans)
+}
+
+// inputRange returns the input range of the range of the converted input,
+// for Options.ArraysAsObjects and Options.ArrayNullMode. Inserted ranges
+// have no length.
+func (st *prettyState) inputRange(start, end int) (int, int) {
+	for n := len(st.convs) - 1; n >= 0; n-- {
+		s, inserted := inputOffset(st.convs[n], start)
+		if end > start && !inserted {
+			end, _ = inputOffset(st.convs[n], end-1)
+			end++
+		} else {
+			end = s
+		}
+		start = s
+	}
+	return start, end
+}
+
+// SyntaxError is a description of a JSON syntax error, including the byte
+// offset of the first invalid character.
+type SyntaxError struct {
+	Msg    string
+	Offset int
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg + " at offset " + strconv.Itoa(e.Offset)
+}
+
+func syntaxError(json []byte, i int, what string) *SyntaxError {
+	if i >= len(json) {
+		return &SyntaxError{"unexpected end of input", i}
+	}
+	return &SyntaxError{"invalid character " + strconv.QuoteRune(rune(json[i])) +
+		" " + what, i}
+}
+
+// UglyStrict is like Ugly but validates the input per the official spec
+// https://tools.ietf.org/html/rfc8259 while compacting. On success the
+// result is the same as Ugly. Otherwise a *SyntaxError with the offset of
+// the first violation is returned.
+func UglyStrict(json []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(json))
+	var stack []byte
+	var i int
+	var err *SyntaxError
+	for {
+		i = skipStrictSpace(json, i)
+		if len(stack) > 0 && stack[len(stack)-1] == '{' {
+			// object key
+			if i >= len(json) || json[i] != '"' {
+				return dst, syntaxError(json, i, "looking for object key")
 			}
-			if esc {
-				dst = append(dst, style.Escape[1]...)
-			} else if key {
-				dst = append(dst, style.Key[1]...)
-			} else {
-				dst = append(dst, style.String[1]...)
+			if dst, i, err = appendStrictString(dst, json, i); err != nil {
+				return dst, err
 			}
-		} else if src[i] == '{' || src[i] == '[' {
-			stack = append(stack, stackt{src[i], src[i] == '{'})
-			dst = append(dst, style.Brackets[0]...)
-			dst = apnd(dst, src[i])
-			dst = append(dst, style.Brackets[1]...)
-		} else if (src[i] == '}' || src[i] == ']') && len(stack) > 0 {
-			stack = stack[:len(stack)-1]
-			dst = append(dst, style.Brackets[0]...)
-			dst = apnd(dst, src[i])
-			dst = append(dst, style.Brackets[1]...)
-		} else if (src[i] == ':' || src[i] == ',') && len(stack) > 0 && stack[len(stack)-1].kind == '{' {
-			stack[len(stack)-1].key = !stack[len(stack)-1].key
-			dst = append(dst, style.Brackets[0]...)
-			dst = apnd(dst, src[i])
-			dst = append(dst, style.Brackets[1]...)
-		} else {
-			var kind byte
-			if (src[i] >= '0' && src[i] <= '9') || src[i] == '-' || isNaNOrInf(src[i:]) {
-				kind = '0'
-				dst = append(dst, style.Number[0]...)
-			} else if src[i] == 't' {
-				kind = 't'
-				dst = append(dst, style.True[0]...)
-			} else if src[i] == 'f' {
-				kind = 'f'
-				dst = append(dst, style.False[0]...)
-			} else if src[i] == 'n' {
-				kind = 'n'
-				dst = append(dst, style.Null[0]...)
-			} else {
-				dst = apnd(dst, src[i])
+			i = skipStrictSpace(json, i)
+			if i >= len(json) || json[i] != ':' {
+				return dst, syntaxError(json, i, "after object key")
 			}
-			if kind != 0 {
-				for ; i < len(src); i++ {
-					if src[i] <= ' ' || src[i] == ',' || src[i] == ':' || src[i] == ']' || src[i] == '}' {
-						i--
-						break
-					}
-					dst = apnd(dst, src[i])
+			dst = append(dst, ':')
+			i = skipStrictSpace(json, i+1)
+		}
+		if i >= len(json) {
+			return dst, syntaxError(json, i, "")
+		}
+		switch json[i] {
+		case '{', '[':
+			dst = append(dst, json[i])
+			j := skipStrictSpace(json, i+1)
+			if j < len(json) && json[j] == json[i]+2 {
+				// empty object or array
+				dst = append(dst, json[j])
+				i = j + 1
+				break
+			}
+			stack = append(stack, json[i])
+			i++
+			continue
+		case '"':
+			dst, i, err = appendStrictString(dst, json, i)
+		case 't':
+			dst, i, err = appendStrictLiteral(dst, json, i, "true")
+		case 'f':
+			dst, i, err = appendStrictLiteral(dst, json, i, "false")
+		case 'n':
+			dst, i, err = appendStrictLiteral(dst, json, i, "null")
+		default:
+			dst, i, err = appendStrictNumber(dst, json, i)
+		}
+		if err != nil {
+			return dst, err
+		}
+		// after a value
+		for {
+			i = skipStrictSpace(json, i)
+			if len(stack) == 0 {
+				if i < len(json) {
+					return dst, syntaxError(json, i, "after top-level value")
 				}
-				if kind == '0' {
-					dst = append(dst, style.Number[1]...)
-				} else if kind == 't' {
-					dst = append(dst, style.True[1]...)
-				} else if kind == 'f' {
-					dst = append(dst, style.False[1]...)
-				} else if kind == 'n' {
-					dst = append(dst, style.Null[1]...)
+				return dst, nil
+			}
+			if i >= len(json) {
+				return dst, syntaxError(json, i, "")
+			}
+			top := stack[len(stack)-1]
+			if json[i] == top+2 {
+				dst = append(dst, json[i])
+				stack = stack[:len(stack)-1]
+				i++
+				continue
+			}
+			if json[i] != ',' {
+				if top == '{' {
+					return dst, syntaxError(json, i, "after object key:value pair")
 				}
+				return dst, syntaxError(json, i, "after array element")
+			}
+			dst = append(dst, ',')
+			j := skipStrictSpace(json, i+1)
+			if j < len(json) && (json[j] == '}' || json[j] == ']') {
+				return dst, &SyntaxError{"trailing comma", i}
 			}
+			i++
+			break
 		}
 	}
-	return dst
 }
 
-// Spec strips out comments and trailing commas and convert the input to a
-// valid JSON per the official spec: https://tools.ietf.org/html/rfc8259
-//
-// The resulting JSON will always be the same length as the input and it will
-// include all of the same line breaks at matching offsets. This is to ensure
-// the result can be later processed by a external parser and that that
-// parser will report messages or errors with the correct offsets.
-func Spec(src []byte) []byte {
-	return spec(src, nil)
+// ValidReader reads the json document from r and validates it per the
+// official spec, like UglyStrict, without keeping the whole document in
+// memory. A *SyntaxError with the offset of the first violation is
+// returned for invalid documents. Errors from r are returned as is.
+func ValidReader(r io.Reader) error {
+	var v validator
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			if err := v.step(c); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := v.end(); err != nil {
+		return err
+	}
+	return nil
 }
 
-// SpecInPlace is the same as Spec, but this method reuses the input json
-// buffer to avoid allocations. Do not use the original bytes slice upon return.
-func SpecInPlace(src []byte) []byte {
-	return spec(src, src)
+// validator states
+const (
+	vValue      = iota // looking for a value
+	vValueOrEnd        // after [
+	vKey               // looking for a key, after a comma
+	vKeyOrEnd          // after {
+	vColon             // after a key
+	vNext              // after a value
+	vString            // in a string
+	vEscape            // after a backslash in a string
+	vHex               // in the digits of a \u escape
+	vLiteral           // in true, false or null
+	vMinus             // after the sign of a number
+	vZero              // after a leading zero
+	vInt               // in the integer digits
+	vDot               // after the decimal point
+	vFrac              // in the fraction digits
+	vE                 // after the exponent marker
+	vESign             // after the exponent sign
+	vExp               // in the exponent digits
+)
+
+// validator is the state of ValidReader, which is fed a byte at a time so
+// that it can stop and resume anywhere in the input.
+type validator struct {
+	state  int
+	stack  []byte
+	key    bool   // the string is a key
+	lit    string // the literal, for vLiteral
+	n      int    // the position in the literal or \u escape
+	offset int    // the offset of the next byte
+	comma  int    // the offset of the last comma
 }
 
-func spec(src, dst []byte) []byte {
-	dst = dst[:0]
-	for i := 0; i < len(src); i++ {
-		if src[i] == '/' {
-			if i < len(src)-1 {
-				if src[i+1] == '/' {
-					dst = append(dst, ' ', ' ')
-					i += 2
-					for ; i < len(src); i++ {
-						if src[i] == '\n' {
-							dst = append(dst, '\n')
-							break
-						} else if src[i] == '\t' || src[i] == '\r' {
-							dst = append(dst, src[i])
-						} else {
-							dst = append(dst, ' ')
-						}
-					}
-					continue
-				}
-				if src[i+1] == '*' {
-					dst = append(dst, ' ', ' ')
-					i += 2
-					for ; i < len(src)-1; i++ {
-						if src[i] == '*' && src[i+1] == '/' {
-							dst = append(dst, ' ', ' ')
-							i++
-							break
-						} else if src[i] == '\n' || src[i] == '\t' ||
-							src[i] == '\r' {
-							dst = append(dst, src[i])
-						} else {
-							dst = append(dst, ' ')
-						}
-					}
-					continue
-				}
-			}
+func (v *validator) fail(c byte, what string) *SyntaxError {
+	return &SyntaxError{"invalid character " + strconv.QuoteRune(rune(c)) +
+		" " + what, v.offset}
+}
+
+// step validates the next byte of the input.
+func (v *validator) step(c byte) *SyntaxError {
+	err := v.next(c)
+	v.offset++
+	return err
+}
+
+func (v *validator) next(c byte) *SyntaxError {
+	space := c == ' ' || c == '\t' || c == '\n' || c == '\r'
+	switch v.state {
+	case vValue, vValueOrEnd:
+		switch {
+		case space:
+		case (c == ']' || c == '}') && v.state == vValue && len(v.stack) > 0 &&
+			v.stack[len(v.stack)-1] == '[':
+			// after a comma in an array
+			return &SyntaxError{"trailing comma", v.comma}
+		case c == ']' && v.state == vValueOrEnd:
+			v.stack = v.stack[:len(v.stack)-1]
+			v.state = vNext
+		case c == '{':
+			v.stack = append(v.stack, c)
+			v.state = vKeyOrEnd
+		case c == '[':
+			v.stack = append(v.stack, c)
+			v.state = vValueOrEnd
+		case c == '"':
+			v.state, v.key = vString, false
+		case c == 't':
+			v.state, v.lit, v.n = vLiteral, "true", 1
+		case c == 'f':
+			v.state, v.lit, v.n = vLiteral, "false", 1
+		case c == 'n':
+			v.state, v.lit, v.n = vLiteral, "null", 1
+		case c == '-':
+			v.state = vMinus
+		case c == '0':
+			v.state = vZero
+		case c >= '1' && c <= '9':
+			v.state = vInt
+		default:
+			return v.fail(c, "looking for beginning of value")
 		}
-		dst = append(dst, src[i])
-		if src[i] == '"' {
-			for i = i + 1; i < len(src); i++ {
-				dst = append(dst, src[i])
-				if src[i] == '"' {
-					j := i - 1
-					for ; ; j-- {
-						if src[j] != '\\' {
-							break
-						}
-					}
-					if (j-i)%2 != 0 {
-						break
+	case vKey, vKeyOrEnd:
+		switch {
+		case space:
+		case (c == '}' || c == ']') && v.state == vKey:
+			return &SyntaxError{"trailing comma", v.comma}
+		case c == '}':
+			v.stack = v.stack[:len(v.stack)-1]
+			v.state = vNext
+		case c == '"':
+			v.state, v.key = vString, true
+		default:
+			return v.fail(c, "looking for object key")
+		}
+	case vColon:
+		switch {
+		case space:
+		case c == ':':
+			v.state = vValue
+		default:
+			return v.fail(c, "after object key")
+		}
+	case vNext:
+		if space {
+			break
+		}
+		if len(v.stack) == 0 {
+			return v.fail(c, "after top-level value")
+		}
+		top := v.stack[len(v.stack)-1]
+		switch {
+		case c == top+2:
+			v.stack = v.stack[:len(v.stack)-1]
+		case c == ',' && top == '{':
+			v.state, v.comma = vKey, v.offset
+		case c == ',':
+			v.state, v.comma = vValue, v.offset
+		case top == '{':
+			return v.fail(c, "after object key:value pair")
+		default:
+			return v.fail(c, "after array element")
+		}
+	case vString:
+		switch {
+		case c < ' ':
+			return v.fail(c, "in string literal")
+		case c == '"' && v.key:
+			v.state = vColon
+		case c == '"':
+			v.state = vNext
+		case c == '\\':
+			v.state = vEscape
+		}
+	case vEscape:
+		switch c {
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			v.state = vString
+		case 'u':
+			v.state, v.n = vHex, 0
+		default:
+			return v.fail(c, "in string escape code")
+		}
+	case vHex:
+		if !isHex(c) {
+			return v.fail(c, "in \\u hexadecimal character escape")
+		}
+		if v.n++; v.n == 4 {
+			v.state = vString
+		}
+	case vLiteral:
+		if c != v.lit[v.n] {
+			return v.fail(c, "in literal "+v.lit)
+		}
+		if v.n++; v.n == len(v.lit) {
+			v.state = vNext
+		}
+	case vMinus:
+		switch {
+		case c == '0':
+			v.state = vZero
+		case c >= '1' && c <= '9':
+			v.state = vInt
+		default:
+			return v.fail(c, "looking for beginning of value")
+		}
+	case vDot:
+		if c < '0' || c > '9' {
+			return v.fail(c, "after decimal point in numeric literal")
+		}
+		v.state = vFrac
+	case vE, vESign:
+		switch {
+		case c >= '0' && c <= '9':
+			v.state = vExp
+		case (c == '+' || c == '-') && v.state == vE:
+			v.state = vESign
+		default:
+			return v.fail(c, "in exponent of numeric literal")
+		}
+	default:
+		// vZero, vInt, vFrac and vExp, where the number may end
+		switch {
+		case c >= '0' && c <= '9' && v.state != vZero:
+		case c == '.' && (v.state == vZero || v.state == vInt):
+			v.state = vDot
+		case (c == 'e' || c == 'E') && v.state != vExp:
+			v.state = vE
+		default:
+			v.state = vNext
+			return v.next(c)
+		}
+	}
+	return nil
+}
+
+// end validates the end of the input.
+func (v *validator) end() *SyntaxError {
+	switch v.state {
+	case vZero, vInt, vFrac, vExp:
+		v.state = vNext
+	}
+	if v.state != vNext || len(v.stack) > 0 {
+		return &SyntaxError{"unexpected end of input", v.offset}
+	}
+	return nil
+}
+
+// skipStrictSpace returns the position of the first byte at or after i
+// that is not a space, tab, newline or carriage return, which are the
+// only whitespace of the official spec.
+func skipStrictSpace(json []byte, i int) int {
+	for ; i < len(json); i++ {
+		switch json[i] {
+		case ' ', '\t', '\n', '\r':
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+func appendStrictString(dst, json []byte, i int) ([]byte, int, *SyntaxError) {
+	s, end := i, scanString(json, i)
+	for i = i + 1; i < end; i++ {
+		switch {
+		case json[i] < ' ':
+			return dst, i, syntaxError(json, i, "in string literal")
+		case json[i] == '"':
+			return append(dst, json[s:end]...), end, nil
+		case json[i] == '\\':
+			i++
+			if i >= end {
+				break
+			}
+			switch json[i] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				for j := 0; j < 4; j++ {
+					i++
+					if i >= len(json) || !isHex(json[i]) {
+						return dst, i, syntaxError(json, i,
+							"in \\u hexadecimal character escape")
 					}
 				}
+			default:
+				return dst, i, syntaxError(json, i, "in string escape code")
 			}
-		} else if src[i] == '}' || src[i] == ']' {
-			for j := len(dst) - 2; j >= 0; j-- {
-				if dst[j] <= ' ' {
-					continue
-				}
-				if dst[j] == ',' {
-					dst[j] = ' '
-				}
+		}
+	}
+	return dst, len(json), syntaxError(json, len(json), "")
+}
+
+func appendStrictLiteral(dst, json []byte, i int, lit string) ([]byte, int, *SyntaxError) {
+	for j := 0; j < len(lit); j++ {
+		if i+j >= len(json) || json[i+j] != lit[j] {
+			return dst, i + j, syntaxError(json, i+j, "in literal "+lit)
+		}
+	}
+	return append(dst, lit...), i + len(lit), nil
+}
+
+func appendStrictNumber(dst, json []byte, i int) ([]byte, int, *SyntaxError) {
+	s := i
+	if i < len(json) && json[i] == '-' {
+		i++
+	}
+	if i >= len(json) || json[i] < '0' || json[i] > '9' {
+		return dst, i, syntaxError(json, i, "looking for beginning of value")
+	}
+	if json[i] == '0' {
+		i++
+	} else {
+		i = skipDigits(json, i)
+	}
+	if i < len(json) && json[i] == '.' {
+		i++
+		if i >= len(json) || json[i] < '0' || json[i] > '9' {
+			return dst, i, syntaxError(json, i, "after decimal point in numeric literal")
+		}
+		i = skipDigits(json, i)
+	}
+	if i < len(json) && (json[i] == 'e' || json[i] == 'E') {
+		i++
+		if i < len(json) && (json[i] == '+' || json[i] == '-') {
+			i++
+		}
+		if i >= len(json) || json[i] < '0' || json[i] > '9' {
+			return dst, i, syntaxError(json, i, "in exponent of numeric literal")
+		}
+		i = skipDigits(json, i)
+	}
+	return append(dst, json[s:i]...), i, nil
+}
+
+func skipDigits(json []byte, i int) int {
+	for ; i < len(json); i++ {
+		if json[i] < '0' || json[i] > '9' {
+			break
+		}
+	}
+	return i
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') ||
+		(c >= 'A' && c <= 'F')
+}
+
+// DecodeToUTF8 transcodes json that starts with a UTF-16 byte order mark,
+// either big or little endian, to UTF-8. A UTF-8 byte order mark is removed.
+// Input without a byte order mark is returned unchanged. Unpaired surrogates
+// are replaced with U+FFFD.
+func DecodeToUTF8(json []byte) ([]byte, error) {
+	if len(json) >= 3 && json[0] == 0xEF && json[1] == 0xBB && json[2] == 0xBF {
+		return json[3:], nil
+	}
+	if len(json) < 2 {
+		return json, nil
+	}
+	var order binary.ByteOrder
+	switch {
+	case json[0] == 0xFE && json[1] == 0xFF:
+		order = binary.BigEndian
+	case json[0] == 0xFF && json[1] == 0xFE:
+		order = binary.LittleEndian
+	default:
+		return json, nil
+	}
+	json = json[2:]
+	if len(json)%2 != 0 {
+		return nil, errors.New("invalid UTF-16 input: odd number of bytes")
+	}
+	units := make([]uint16, len(json)/2)
+	for i := range units {
+		units[i] = order.Uint16(json[i*2:])
+	}
+	dst := make([]byte, 0, len(units))
+	for _, r := range utf16.Decode(units) {
+		dst = appendRune(dst, r)
+	}
+	return dst, nil
+}
+
+func appendRune(dst []byte, r rune) []byte {
+	var b [utf8.UTFMax]byte
+	n := utf8.EncodeRune(b[:], r)
+	return append(dst, b[:n]...)
+}
+
+// PrettyPrinter is an io.Writer that collects json documents, such as from
+// a json.Encoder, and writes them pretty on Flush or Close. Multiple
+// documents, such as newline delimited json, are formatted one after the
+// other.
+type PrettyPrinter struct {
+	// Options are the formatting options. DefaultOptions when nil.
+	Options *Options
+	// Output is the writer used by Close, which fails when it is nil.
+	Output io.Writer
+	buf    []byte
+}
+
+// NewPrettyPrinter returns a PrettyPrinter that writes to w on Close.
+func NewPrettyPrinter(w io.Writer, opts *Options) *PrettyPrinter {
+	return &PrettyPrinter{Options: opts, Output: w}
+}
+
+// Write adds the bytes to the pending input. It never fails. The bytes may
+// end anywhere, including in the middle of a document.
+func (pp *PrettyPrinter) Write(p []byte) (int, error) {
+	pp.buf = append(pp.buf, p...)
+	return len(p), nil
+}
+
+// Flush writes the complete documents of the pending input to w, each on
+// its own lines. A document that is not complete, or a number or literal
+// at the very end of the input that may continue with the next Write,
+// stays pending.
+func (pp *PrettyPrinter) Flush(w io.Writer) error {
+	return pp.flush(w, false)
+}
+
+// Close writes all pending input to the Output, including a final
+// incomplete document, which is formatted as is. Returns an error, and
+// keeps the pending input, when the Output is nil.
+func (pp *PrettyPrinter) Close() error {
+	return pp.flush(pp.Output, true)
+}
+
+func (pp *PrettyPrinter) flush(w io.Writer, final bool) error {
+	if w == nil {
+		return errors.New("no writer for the pretty output")
+	}
+	var out []byte
+	i := skipSpace(pp.buf, 0)
+	for i < len(pp.buf) {
+		end := valueEnd(pp.buf, i)
+		if end == i {
+			// not a value
+			i = skipSpace(pp.buf, i+1)
+			continue
+		}
+		if end == len(pp.buf) && !final {
+			// add a space to see if the value ends before it
+			tail := append(pp.buf[i:len(pp.buf):len(pp.buf)], ' ')
+			c := pp.buf[i]
+			if valueEnd(tail, 0) == len(tail) ||
+				(c != '{' && c != '[' && c != '"') {
 				break
 			}
 		}
+		out = append(out, PrettyOptions(pp.buf[i:end], pp.Options)...)
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			out = append(out, '\n')
+		}
+		i = skipSpace(pp.buf, end)
 	}
-	return dst
+	pp.buf = append(pp.buf[:0], pp.buf[i:]...)
+	if len(out) == 0 {
+		return nil
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// Builder writes pretty json one member at a time, such as for generating
+// large documents without building them first. The objects and arrays are
+// always expanded, and the keys are not sorted, because the members that
+// follow are not known yet. The calls must make a valid document, which is
+// not checked.
+type Builder struct {
+	// Options are the formatting options. DefaultOptions when nil. Only
+	// the Prefix, Indent, BaseIndent and OmitFirstLinePrefix are used,
+	// other than by RawValue.
+	Options *Options
+	buf     []byte
+	stack   []builderLevel
+}
+
+// builderLevel is an open object or array of a Builder, with its number of
+// members, and whether its next value follows a key.
+type builderLevel struct {
+	n     int
+	value bool
+}
+
+func (b *Builder) opts() *Options {
+	if b.Options == nil {
+		return DefaultOptions
+	}
+	return b.Options
+}
+
+// begin starts a key or value on a new line, unless it is the value of a
+// key.
+func (b *Builder) begin() {
+	opts := b.opts()
+	if len(b.stack) == 0 {
+		if !opts.OmitFirstLinePrefix {
+			b.buf = appendTabs(b.buf, opts.Prefix, opts.Indent, opts.BaseIndent)
+		}
+		return
+	}
+	top := &b.stack[len(b.stack)-1]
+	if top.value {
+		top.value = false
+		return
+	}
+	if top.n > 0 {
+		b.buf = append(b.buf, ',')
+	}
+	top.n++
+	b.buf = append(b.buf, '\n')
+	b.buf = appendTabs(b.buf, opts.Prefix, opts.Indent, opts.BaseIndent+len(b.stack))
+}
+
+func (b *Builder) open(c byte) {
+	b.begin()
+	b.buf = append(b.buf, c)
+	b.stack = append(b.stack, builderLevel{})
+}
+
+func (b *Builder) close(c byte) {
+	opts := b.opts()
+	if len(b.stack) == 0 {
+		return
+	}
+	n := b.stack[len(b.stack)-1].n
+	b.stack = b.stack[:len(b.stack)-1]
+	if n > 0 {
+		b.buf = append(b.buf, '\n')
+		b.buf = appendTabs(b.buf, opts.Prefix, opts.Indent, opts.BaseIndent+len(b.stack))
+	}
+	b.buf = append(b.buf, c)
+	if len(b.stack) == 0 && n > 0 {
+		b.buf = append(b.buf, '\n')
+	}
+}
+
+// BeginObject starts an object.
+func (b *Builder) BeginObject() { b.open('{') }
+
+// EndObject ends the object that was started last.
+func (b *Builder) EndObject() { b.close('}') }
+
+// BeginArray starts an array.
+func (b *Builder) BeginArray() { b.open('[') }
+
+// EndArray ends the array that was started last.
+func (b *Builder) EndArray() { b.close(']') }
+
+// Key writes the key of the next member of an object, which is followed by
+// its value.
+func (b *Builder) Key(key string) {
+	b.begin()
+	b.buf = AppendEscapedString(b.buf, key)
+	b.buf = append(b.buf, ':', ' ')
+	if len(b.stack) > 0 {
+		b.stack[len(b.stack)-1].value = true
+	}
+}
+
+// String writes a string value.
+func (b *Builder) String(s string) {
+	b.begin()
+	b.buf = AppendEscapedString(b.buf, s)
 }
+
+// RawValue writes the json value, which is formatted with the Options at
+// the depth of the value.
+func (b *Builder) RawValue(value []byte) {
+	b.begin()
+	opts := *b.opts()
+	opts.BaseIndent += len(b.stack)
+	opts.OmitFirstLinePrefix = true
+	out := PrettyOptions(value, &opts)
+	if len(b.stack) > 0 && len(out) > 0 && out[len(out)-1] == '\n' {
+		out = out[:len(out)-1]
+	}
+	b.buf = append(b.buf, out...)
+}
+
+// Bytes returns the json that was written.
+func (b *Builder) Bytes() []byte { return b.buf }
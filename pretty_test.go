@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
+	"unicode/utf16"
 )
 
 func j(js interface{}) string {
@@ -67,6 +70,88 @@ func TestPretty(t *testing.T) {
 	assertEqual(t, j(example2), j(pretty))
 }
 
+func TestBlankInput(t *testing.T) {
+	for _, json := range []string{"", " ", "\n\t\r "} {
+		assertEqual(t, "", string(Pretty([]byte(json))))
+		assertEqual(t, "", string(PrettyOptions([]byte(json), &Options{Prefix: "> ", BaseIndent: 1})))
+		assertEqual(t, "", string(Ugly([]byte(json))))
+		assertEqual(t, "", string(Color([]byte(json), nil)))
+		assertEqual(t, "x", string(ColorAppend([]byte("x"), []byte(json), nil)))
+		assertEqual(t, "", string(ColorSemantic([]byte(json), nil, nil)))
+		assertEqual(t, "", string(ColorKeysOnly([]byte(json), [2]string{"<", ">"})))
+		assertEqual(t, "x", string(ColorContinue([]byte("x"), []byte(json), nil)))
+		var out bytes.Buffer
+		if err := ColorLines(&out, []byte(json), nil); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, "", out.String())
+		if err := ColorReaderWriter(&out, iotest.OneByteReader(strings.NewReader(json)), nil); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, "", out.String())
+		cw := NewColorWriter(&out, nil)
+		cw.Write([]byte(json))
+		cw.Flush()
+		assertEqual(t, strings.Repeat("\n", strings.Count(json, "\n")), out.String())
+		assertEqual(t, "", string(Spec([]byte(json))))
+		assertEqual(t, "", string(SpecInPlace([]byte(json))))
+	}
+	// the blank lines of newline delimited json are written empty, and the
+	// whitespace prior to a value is kept
+	var out bytes.Buffer
+	ColorLines(&out, []byte("1\n \n2"), nil)
+	assertEqual(t, string(Color([]byte("1"), nil))+"\n\n"+string(Color([]byte("2"), nil)),
+		out.String())
+	out.Reset()
+	json := []byte(" \n [1]")
+	ColorReaderWriter(&out, iotest.OneByteReader(bytes.NewReader(json)), nil)
+	assertEqual(t, string(Color(json, nil)), out.String())
+}
+
+func TestPrettyAuto(t *testing.T) {
+	defer func(fn func() int) { terminalWidth = fn }(terminalWidth)
+	json := []byte(`[1,2,3,4,5,6,7,8,9,10]`)
+	terminalWidth = func() int { return 0 }
+	assertEqual(t, "[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]", string(PrettyAuto(json)))
+	terminalWidth = func() int { return 20 }
+	assertEqual(t, "[\n  1,\n  2,\n  3,\n  4,\n  5,\n  6,\n  7,\n  8,\n  9,\n  10\n]\n",
+		string(PrettyAuto(json)))
+}
+
+func TestPrettySafe(t *testing.T) {
+	out, err := PrettySafe([]byte(`[1,2]`), nil)
+	assertEqual(t, nil, err)
+	assertEqual(t, "[1, 2]", string(out))
+	opts := *DefaultOptions
+	opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+		panic("bad token")
+	}
+	out, err = PrettySafe([]byte(`[1,2]`), &opts)
+	assertEqual(t, 0, len(out))
+	assertEqual(t, "panic while formatting: bad token", err.Error())
+}
+
+func TestScanString(t *testing.T) {
+	for _, tc := range []struct {
+		s   string
+		end int
+	}{
+		{`"abc" `, 5},
+		{`"a\"b" `, 6},
+		{`"\\" `, 4},
+		{`"\\\"" `, 6},
+		{`"\\\\\"" `, 8},
+		{`"\u12" `, 6},
+		{`"\u"" `, 4},
+		{`"\u`, 3},
+		{`"abc\`, 5},
+		{`"`, 1},
+	} {
+		assertEqual(t, tc.end, scanString([]byte(tc.s), 0))
+		assertEqual(t, tc.s[:tc.end], string(Ugly([]byte(tc.s))[:tc.end]))
+	}
+}
+
 func TestUgly(t *testing.T) {
 	ugly := Ugly([]byte(example1))
 	var buf bytes.Buffer
@@ -387,6 +472,22 @@ func TestColor(t *testing.T) {
 	}
 }
 
+func TestColorEscapedBackslash(t *testing.T) {
+	// the character after an escaped backslash is not escaped
+	json := []byte(`["a\\b","\\\"c"]`)
+	str := func(s string) string { return "\x1b[32m" + s + "\x1b[0m" }
+	esc := func(s string) string { return "\x1b[35m" + s + "\x1b[0m" }
+	punct := func(s string) string { return "\x1b[1m" + s + "\x1b[0m" }
+	assertEqual(t, punct("[")+str(`"a`)+esc(`\\`)+str(`b"`)+","+
+		str(`"`)+esc(`\\`)+str("")+esc(`\"`)+str(`c"`)+punct("]"),
+		string(Color(json, nil)))
+	var out bytes.Buffer
+	if err := ColorReaderWriter(&out, bytes.NewReader(json), nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(Color(json, nil)), out.String())
+}
+
 func BenchmarkPretty(t *testing.B) {
 	t.ReportAllocs()
 	t.ResetTimer()
@@ -582,3 +683,2283 @@ func TestSingleLineArray(t *testing.T) {
 		t.Fatalf("expected '%s', got '%s'", expect, prettied)
 	}
 }
+
+func TestMaxBytes(t *testing.T) {
+	opts := *DefaultOptions
+	opts.MaxBytes = 60
+	out := string(PrettyOptions(example1, &opts))
+	expect := "{\n  \"name\": {\n    \"last\": \"Sanders\",\n    ...\n  }\n}\n"
+	if out != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, out)
+	}
+	for i := 0; i < 300; i++ {
+		opts.MaxBytes = i
+		out := PrettyOptions(example1, &opts)
+		if i > 0 && len(out) > i {
+			t.Fatalf("expected at most %d bytes, got %d", i, len(out))
+		}
+		if bytes.Count(out, []byte("{")) != bytes.Count(out, []byte("}")) ||
+			bytes.Count(out, []byte("[")) != bytes.Count(out, []byte("]")) {
+			t.Fatalf("unbalanced output '%s'", out)
+		}
+	}
+	opts.MaxBytes = 1000
+	assertEqual(t, string(Pretty(example1)), string(PrettyOptions(example1, &opts)))
+	// too small for the closed brackets, or a long root string
+	for i := 1; i < 10; i++ {
+		opts.MaxBytes = i
+		out := string(PrettyOptions([]byte(`{"a":1,"b":2}`), &opts))
+		if i < 3 {
+			assertEqual(t, "", out)
+		} else {
+			assertEqual(t, "...", out)
+		}
+	}
+	opts.MaxBytes = 10
+	assertEqual(t, "{\n  ...\n}\n", string(PrettyOptions([]byte(`{"a":1,"b":2}`), &opts)))
+	opts.MaxBytes = 15
+	assertEqual(t, "...", string(PrettyOptions([]byte(`"a string that is longer than that"`), &opts)))
+	// sorted keys are cut after sorting
+	opts.SortKeys = true
+	opts.MaxBytes = 30
+	assertEqual(t, "{\n  \"a\": 1,\n  \"b\": 2,\n  ...\n}\n",
+		string(PrettyOptions([]byte(`{"z":26,"y":25,"b":2,"a":1,"c":3}`), &opts)))
+	opts.PreserveComments = true
+	opts.MaxBytes = 40
+	assertEqual(t, "{\n  \"a\": 1,\n  // b\n  \"b\": 2,\n  ...\n}\n",
+		string(PrettyOptions([]byte("{\"z\":26,/* y */\"y\":25,// b\n\"b\":2,\"a\":1}"), &opts)))
+}
+
+func TestValueAtPointer(t *testing.T) {
+	json := []byte(`{
+		"user": {"addresses": [{"city": "Tempe"}, {"city": "Mesa"}]},
+		"a/b": 1, "m~n": [true], "": "empty", "esc\"aped": null
+	}`)
+	tests := []struct {
+		ptr    string
+		expect string
+		ok     bool
+	}{
+		{"", string(json[:]), true},
+		{"/user/addresses/0/city", `"Tempe"`, true},
+		{"/user/addresses/1", `{"city": "Mesa"}`, true},
+		{"/a~1b", `1`, true},
+		{"/m~0n/0", `true`, true},
+		{"/", `"empty"`, true},
+		{"/esc\"aped", `null`, true},
+		{"/user/addresses/2", "", false},
+		{"/user/addresses/01", "", false},
+		{"/user/addresses/-", "", false},
+		{"/user/name", "", false},
+		{"user", "", false},
+	}
+	for _, tt := range tests {
+		val, ok := ValueAtPointer(json, tt.ptr)
+		if ok != tt.ok || string(val) != tt.expect {
+			t.Fatalf("%q: expected '%s' %t, got '%s' %t",
+				tt.ptr, tt.expect, tt.ok, val, ok)
+		}
+	}
+}
+
+func TestSortKeysTopLevelOnly(t *testing.T) {
+	json := `{"c":{"z":1,"y":2},"a":[{"q":1,"p":2}],"b":3}`
+	opts := *DefaultOptions
+	opts.SortKeysTopLevelOnly = true
+	out := string(Ugly(PrettyOptions([]byte(json), &opts)))
+	expect := `{"a":[{"q":1,"p":2}],"b":3,"c":{"z":1,"y":2}}`
+	if out != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, out)
+	}
+}
+
+func TestSortValuesIgnoreFormatting(t *testing.T) {
+	json := `{"k":[2,2,2,2,2,2,2,2,2,2,2,2,2,2],"k":[1,2]}`
+	opts := *DefaultOptions
+	opts.SortKeys = true
+	opts.Width = 30
+	out := string(Ugly(PrettyOptions([]byte(json), &opts)))
+	expect := `{"k":[1,2],"k":[2,2,2,2,2,2,2,2,2,2,2,2,2,2]}`
+	if out != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, out)
+	}
+}
+
+func TestSortByValue(t *testing.T) {
+	json := []byte(`{"d":2,"c":"x","b":10,"a":2,"e":[1],"f":null}`)
+	opts := *DefaultOptions
+	opts.SortKeys = true
+	opts.SortBy = SortByValue
+	expect := `{"f":null,"a":2,"d":2,"b":10,"c":"x","e":[1]}`
+	assertEqual(t, expect, string(Ugly(PrettyOptions(json, &opts))))
+	out := PrettyOptions(json, &opts)
+	opts.Colorize = TerminalStyle
+	assertEqual(t, string(Color(out, TerminalStyle)), string(PrettyOptions(json, &opts)))
+}
+
+func TestOnToken(t *testing.T) {
+	json := []byte(`{"b":[1,"x"],"a":{"c":true},"d":null}`)
+	type tok struct {
+		kind                       TokenKind
+		srcStart, srcEnd, dstStart int
+		dstEnd                     int
+	}
+	for _, sortKeys := range []bool{false, true} {
+		opts := *DefaultOptions
+		opts.SortKeys = sortKeys
+		var toks []tok
+		opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+			toks = append(toks, tok{kind, srcStart, srcEnd, dstStart, dstEnd})
+		}
+		out := PrettyOptions(json, &opts)
+		if len(toks) != 11 {
+			t.Fatalf("expected 11 tokens, got %d", len(toks))
+		}
+		for i, tk := range toks {
+			if i > 0 && tk.dstStart < toks[i-1].dstStart {
+				t.Fatalf("out of order")
+			}
+			src := Ugly(json[tk.srcStart:tk.srcEnd])
+			dst := Ugly(out[tk.dstStart:tk.dstEnd])
+			if tk.kind == TokenObject && sortKeys {
+				continue
+			}
+			if !bytes.Equal(src, dst) {
+				t.Fatalf("expected '%s', got '%s'", src, dst)
+			}
+		}
+	}
+}
+
+func TestOmitFirstLinePrefix(t *testing.T) {
+	opts := *DefaultOptions
+	opts.Prefix = "> "
+	out := string(PrettyOptions([]byte(`{"a":1}`), &opts))
+	assertEqual(t, "> {\n>   \"a\": 1\n> }\n", out)
+	opts.OmitFirstLinePrefix = true
+	out = string(PrettyOptions([]byte(`{"a":1}`), &opts))
+	assertEqual(t, "{\n>   \"a\": 1\n> }\n", out)
+}
+
+func TestGroupDigits(t *testing.T) {
+	opts := *DefaultOptions
+	opts.GroupDigits = true
+	json := `[0, 100, 1000, -1234567, 12345.6789, 1000000e10, -100, NaN]`
+	out := string(PrettyOptions([]byte(json), &opts))
+	expect := "[0, 100, 1,000, -1,234,567, 12,345.6789, 1,000,000e10, -100, NaN]"
+	assertEqual(t, expect, out)
+}
+
+func TestUglyStrict(t *testing.T) {
+	for _, json := range [][]byte{example1, []byte(example2),
+		[]byte(` [ ] `), []byte(`{ "a" : { } }`), []byte(`-0.5e+10`),
+		[]byte(`"é\/\""`)} {
+		out, err := UglyStrict(json)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, string(Ugly(json)), string(out))
+	}
+	tests := []struct {
+		json   string
+		offset int
+	}{
+		{`[1,2,]`, 4},
+		{`{"a":1,}`, 6},
+		{`[1,2`, 4},
+		{`[1,2}`, 4},
+		{`{"a":1]`, 6},
+		{`"\x"`, 2},
+		{`"\u12g4"`, 5},
+		{`{"a" 1}`, 5},
+		{`{1:1}`, 1},
+		{`01`, 1},
+		{`1.`, 2},
+		{`tru`, 3},
+		{`[1] [2]`, 4},
+		{"\"a\tb\"", 2},
+		{``, 0},
+		// only space, tab, newline and carriage return are whitespace
+		{"\x00{}", 0},
+		{"[1,\x012]", 3},
+		{"{\"a\":\v1}", 5},
+		{"[1]\f", 3},
+	}
+	for _, tt := range tests {
+		_, err := UglyStrict([]byte(tt.json))
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Fatalf("%s: expected a syntax error, got %v", tt.json, err)
+		}
+		if serr.Offset != tt.offset {
+			t.Fatalf("%s: expected offset %d, got %d (%s)",
+				tt.json, tt.offset, serr.Offset, serr)
+		}
+	}
+}
+
+func TestPrettyOrderedLike(t *testing.T) {
+	template := []byte(`{"id":0,"name":"","tags":[],"meta":{"b":0,"a":0}}`)
+	json := []byte(`{"meta":{"z":1,"a":2,"b":3},"extra":1,"name":"x","id":5,"alpha":true}`)
+	out := string(Ugly(PrettyOrderedLike(json, template, nil)))
+	expect := `{"id":5,"name":"x","meta":{"b":3,"a":2,"z":1},"alpha":true,"extra":1}`
+	assertEqual(t, expect, out)
+}
+
+func TestColorize(t *testing.T) {
+	json := []byte(`
+{"hello":"world","what":123,"esc":"a\"b c",
+"arr":["1","2",1,2,true,false,null],
+"obj":{"key1":null,"ar` + "\x1B[36m" + `Cyanr2":[1,2,3,"123","456"]},
+"long":["aaaaaaaaaa","bbbbbbbbbb","cccccccccc","dddddddddd","eeeeeeeeee"],
+"empty":{},"none":[]}
+	`)
+	for _, sortKeys := range []bool{false, true} {
+		opts := *DefaultOptions
+		opts.SortKeys = sortKeys
+		expect := string(Color(PrettyOptions(json, &opts), nil))
+		opts.Colorize = TerminalStyle
+		out := string(PrettyOptions(json, &opts))
+		if out != expect {
+			t.Fatalf("expected '%s', got '%s'", expect, out)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	stats := Stats(example1)
+	expect := Statistics{
+		Objects: 6, Arrays: 4, Keys: 10, Strings: 6, Numbers: 6,
+		Booleans: 2, Nulls: 1, MaxDepth: 4,
+	}
+	assertEqual(t, expect, stats)
+	assertEqual(t, Statistics{Numbers: 1}, Stats([]byte(" 1 ")))
+	assertEqual(t, Statistics{}, Stats(nil))
+}
+
+func TestPackLeafObjects(t *testing.T) {
+	json := []byte(`{"points":[{"x":1,"y":2},{"x":3,"y":4,"z":null}],
+		"nested":{"a":{"b":1}},"tags":["a","b"],
+		"long":{"aaaaaaaaaaaaaaaaaaaa":1,"bbbbbbbbbbbbbbbbbbbb":2,"cccccccccccccccccccc":3}}`)
+	opts := *DefaultOptions
+	opts.PackLeafObjects = true
+	out := string(PrettyOptions(json, &opts))
+	expect := `{
+  "points": [
+    {"x": 1, "y": 2},
+    {"x": 3, "y": 4, "z": null}
+  ],
+  "nested": {
+    "a": {"b": 1}
+  },
+  "tags": ["a", "b"],
+  "long": {
+    "aaaaaaaaaaaaaaaaaaaa": 1,
+    "bbbbbbbbbbbbbbbbbbbb": 2,
+    "cccccccccccccccccccc": 3
+  }
+}
+`
+	assertEqual(t, expect, out)
+	opts.SortKeys = true
+	out = string(PrettyOptions([]byte(`[{"b":1,"a":2}]`), &opts))
+	assertEqual(t, "[\n  {\"a\": 2, \"b\": 1}\n]\n", out)
+	out = string(PrettyOptions([]byte(`{"b":1,"a":2}`), &opts))
+	assertEqual(t, `{"a": 2, "b": 1}`, out)
+	out = string(PrettyOptions([]byte(`{"a" : [1]}`), &opts))
+	assertEqual(t, "{\n  \"a\": [1]\n}\n", out)
+}
+
+func TestBaseIndent(t *testing.T) {
+	opts := *DefaultOptions
+	opts.BaseIndent = 2
+	opts.SortKeysTopLevelOnly = true
+	out := string(PrettyOptions([]byte(`{"b":{"d":1,"c":2},"a":[1,2]}`), &opts))
+	expect := "    {\n" +
+		"      \"a\": [1, 2],\n" +
+		"      \"b\": {\n" +
+		"        \"d\": 1,\n" +
+		"        \"c\": 2\n" +
+		"      }\n" +
+		"    }\n"
+	assertEqual(t, expect, out)
+	opts.OmitFirstLinePrefix = true
+	out = string(PrettyOptions([]byte(`{"a":1}`), &opts))
+	assertEqual(t, "{\n      \"a\": 1\n    }\n", out)
+}
+
+func TestDecodeToUTF8(t *testing.T) {
+	src := `{"name":"Zoë 😀"}`
+	var be, le []byte
+	be = append(be, 0xFE, 0xFF)
+	le = append(le, 0xFF, 0xFE)
+	for _, r := range utf16.Encode([]rune(src)) {
+		be = append(be, byte(r>>8), byte(r))
+		le = append(le, byte(r), byte(r>>8))
+	}
+	for _, in := range [][]byte{be, le, append([]byte{0xEF, 0xBB, 0xBF}, src...),
+		[]byte(src)} {
+		out, err := DecodeToUTF8(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, src, string(out))
+	}
+	if _, err := DecodeToUTF8(be[:len(be)-1]); err == nil {
+		t.Fatal("expected an error")
+	}
+	opts := *DefaultOptions
+	opts.DecodeUTF16 = true
+	assertEqual(t, string(Pretty([]byte(src))), string(PrettyOptions(le, &opts)))
+}
+
+func TestFillArrays(t *testing.T) {
+	var nums []string
+	for i := 0; i < 40; i++ {
+		nums = append(nums, fmt.Sprint(i*37))
+	}
+	json := []byte(`{"nums":[` + strings.Join(nums, ",") + `],"objs":[{"a":1}],"short":[1,2]}`)
+	opts := *DefaultOptions
+	opts.Width = 40
+	opts.FillArrays = true
+	out := string(PrettyOptions(json, &opts))
+	expect := `{
+  "nums": [
+    0, 37, 74, 111, 148, 185, 222, 259,
+    296, 333, 370, 407, 444, 481, 518,
+    555, 592, 629, 666, 703, 740, 777,
+    814, 851, 888, 925, 962, 999, 1036,
+    1073, 1110, 1147, 1184, 1221, 1258,
+    1295, 1332, 1369, 1406, 1443
+  ],
+  "objs": [
+    {
+      "a": 1
+    }
+  ],
+  "short": [1, 2]
+}
+`
+	assertEqual(t, expect, out)
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) > opts.Width {
+			t.Fatalf("line too long: '%s'", line)
+		}
+	}
+	opts.Colorize = TerminalStyle
+	assertEqual(t, string(Color([]byte(expect), nil)), string(PrettyOptions(json, &opts)))
+	// the rows are cut at MaxBytes
+	opts.Colorize = nil
+	opts.Width = 20
+	opts.MaxBytes = 60
+	assertEqual(t, "[\n  1, 2, 3, 4, 5, 6,\n  7, 8, 9, 10, 11,\n  12, 13,\n  ...\n]\n",
+		string(PrettyOptions([]byte(`[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20]`), &opts)))
+}
+
+func TestItemsPerLine(t *testing.T) {
+	json := []byte(`{"grid":[1,2,3,4,5,6,7,8],"short":[1,2],"objs":[{"a":1},2,3]}`)
+	opts := *DefaultOptions
+	opts.Width = 80
+	opts.ItemsPerLine = 3
+	expect := `{
+  "grid": [
+    1, 2, 3,
+    4, 5, 6,
+    7, 8
+  ],
+  "short": [1, 2],
+  "objs": [
+    {
+      "a": 1
+    },
+    2,
+    3
+  ]
+}
+`
+	assertEqual(t, expect, string(PrettyOptions(json, &opts)))
+	// without a width, every scalar array is laid out in rows
+	opts.Width = 0
+	assertEqual(t, strings.Replace(expect, "[1, 2]", "[\n    1, 2\n  ]", 1),
+		string(PrettyOptions(json, &opts)))
+	// a width that is narrower than the items wraps sooner
+	opts.Width = 12
+	assertEqual(t, "[\n  1, 2, 3,\n  4, 5, 6,\n  1000,\n  2000\n]\n",
+		string(PrettyOptions([]byte(`[1,2,3,4,5,6,1000,2000]`), &opts)))
+	// the rows are cut at MaxBytes
+	opts.MaxBytes = 30
+	assertEqual(t, "[\n  1, 2, 3,\n  4, 5,\n  ...\n]\n",
+		string(PrettyOptions([]byte(`[1,2,3,4,5,6,1000,2000]`), &opts)))
+}
+
+func TestPreserveHeader(t *testing.T) {
+	json := []byte("#!/usr/bin/env app\n// config v2\n/* generated */\n{\"a\":[1,2]}")
+	opts := *DefaultOptions
+	opts.PreserveHeader = true
+	assertEqual(t, "#!/usr/bin/env app\n// config v2\n/* generated */\n"+
+		"{\n  \"a\": [1, 2]\n}\n", string(PrettyOptions(json, &opts)))
+	// a comment that is followed by a value is not a header
+	opts.PreserveComments = true
+	assertEqual(t, "// a\n/* b */ {\n  \"a\": 1\n}\n",
+		string(PrettyOptions([]byte("// a\n/* b */ {\"a\":1}"), &opts)))
+	assertEqual(t, `{"a":1}`, string(Ugly(PrettyOptions([]byte(`{"a":1}`), &opts))))
+}
+
+func TestArraysAsObjects(t *testing.T) {
+	opts := *DefaultOptions
+	opts.ArraysAsObjects = true
+	assertEqual(t, "{\n  \"0\": 10,\n  \"1\": 20\n}\n",
+		string(PrettyOptions([]byte(`[10,20]`), &opts)))
+	json := []byte(`{"a":[[],{"b":["x,]", null]}, /* c */ 3]}`)
+	assertEqual(t, `{"a":{"0":{},"1":{"b":{"0":"x,]","1":null}},"2":3}}`,
+		string(Ugly(PrettyOptions(json, &opts))))
+	opts.PreserveComments = true
+	expect := `{
+  "a": {
+    "0": {},
+    "1": {
+      "b": {
+        "0": "x,]",
+        "1": null
+      }
+    },
+    /* c */
+    "2": 3
+  }
+}
+`
+	assertEqual(t, expect, string(PrettyOptions(json, &opts)))
+	// the source offsets are of the input, and the keys are at their elements
+	json = []byte(`{"b":[1,2],"a":"x"}`)
+	out, srcMap := PrettyWithSourceMap(json, &opts)
+	assertEqual(t, "[{0 0 1} {4 1 3} {9 5 1} {15 6 3} {20 6 1} {27 8 3} "+
+		"{32 8 1} {36 9 1} {41 11 3} {46 15 3} {50 18 1}]", fmt.Sprint(srcMap))
+	_, lines := PrettyOptionsMapped(json, &opts)
+	assertEqual(t, "[0 1 6 8 9 11 18]", fmt.Sprint(lines))
+	assertEqual(t, `"a"`, string(out[41:44]))
+	_, consumed := PrettyPrefix(json, 3, &opts)
+	assertEqual(t, 8, consumed)
+	_, consumed = PrettyPrefix(json, 100, &opts)
+	assertEqual(t, len(json), consumed)
+}
+
+func TestArrayNullMode(t *testing.T) {
+	json := []byte(`{"a":[null,1,null,{"b":null},[null]],"c":null,"d":[null]}`)
+	opts := *DefaultOptions
+	assertEqual(t, string(Pretty(json)), string(PrettyOptions(json, &opts)))
+	opts.ArrayNullMode = NullEmpty
+	assertEqual(t, `{"a":["",1,"",{"b":null},[""]],"c":null,"d":[""]}`,
+		string(Ugly(PrettyOptions(json, &opts))))
+	opts.ArrayNullMode = NullDrop
+	assertEqual(t, `{
+  "a": [
+    1,
+    {
+      "b": null
+    },
+    []
+  ],
+  "c": null,
+  "d": []
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.ArraysAsObjects = true
+	assertEqual(t, `{"a":{"0":1,"1":{"b":null},"2":{}},"c":null,"d":{}}`,
+		string(Ugly(PrettyOptions(json, &opts))))
+	// the source offsets are of the input
+	out, srcMap := PrettyWithSourceMap(json, &opts)
+	var keys int
+	for _, m := range srcMap {
+		v := out[m.OutStart : m.OutStart+m.Length]
+		if len(v) == 3 && v[1] >= '0' && v[1] <= '9' {
+			// the key of an element
+			keys++
+			assertEqual(t, true, bytes.IndexByte([]byte("1{["), json[m.InStart]) != -1)
+		} else if v[0] != '{' && v[0] != '}' {
+			assertEqual(t, string(v), string(json[m.InStart:m.InStart+m.Length]))
+		}
+	}
+	assertEqual(t, 3, keys)
+	_, consumed := PrettyPrefix(json, 100, &opts)
+	assertEqual(t, len(json), consumed)
+}
+
+func TestPreserveComments(t *testing.T) {
+	opts := *DefaultOptions
+	opts.PreserveComments = true
+	out := string(PrettyOptions(example3, &opts))
+	expect := `{
+  /* COMMENT 1 */
+  "name": {
+    "last": "Sanders",
+    // outer 1
+    "first": "Janet"
+    // outer 2
+  },
+  // COMMENT 2
+  "children": [
+    "Andy",
+    "Carol",
+    "Mike"
+    // outer 3
+  ],
+  /* 
+  COMMENT 3
+  */
+  "values": [
+    10.10,
+    true,
+    false,
+    null,
+    "hello",
+    {}
+  ],
+  "values2": {},
+  "values3": [],
+  "deep": {
+    "deep": {
+      "deep": [1, 2, 3, 4, 5]
+    }
+  }
+}
+`
+	assertEqual(t, expect, out)
+	assertEqual(t, j(Spec(example3)), j(Spec([]byte(out))))
+	out = string(PrettyOptions([]byte("// head\n{\"a\": /* one */ 1} // tail"), &opts))
+	assertEqual(t, "// head\n{\n  \"a\": /* one */ 1\n}\n// tail\n", out)
+}
+
+func TestMaxInlineArrayElements(t *testing.T) {
+	opts := *DefaultOptions
+	opts.MaxInlineArrayElements = 3
+	out := string(PrettyOptions([]byte(`{"a":[1,2,3],"b":[1,2,3,4],"c":[[1],[2]]}`), &opts))
+	expect := `{
+  "a": [1, 2, 3],
+  "b": [
+    1,
+    2,
+    3,
+    4
+  ],
+  "c": [[1], [2]]
+}
+`
+	assertEqual(t, expect, out)
+}
+
+func TestColorContinue(t *testing.T) {
+	json := []byte(`{"a":[1,"b",true]}`)
+	prefix := "\x1B[31mERROR\x1B[1m "
+	out := string(ColorContinue([]byte(prefix), json, nil))
+	expect := prefix + "\x1B[0m" + string(Color(json, nil)) + "\x1B[0m"
+	assertEqual(t, expect, out)
+}
+
+func TestKeyCollator(t *testing.T) {
+	json := []byte(`{"b":1,"Á":2,"a":3,"B":4}`)
+	opts := *DefaultOptions
+	opts.SortKeys = true
+	assertEqual(t, `{"B":4,"a":3,"b":1,"Á":2}`, string(Ugly(PrettyOptions(json, &opts))))
+	fold := strings.NewReplacer("Á", "a", "A", "a", "B", "b")
+	opts.KeyCollator = func(a, b string) int {
+		return strings.Compare(fold.Replace(a), fold.Replace(b))
+	}
+	assertEqual(t, `{"Á":2,"a":3,"b":1,"B":4}`, string(Ugly(PrettyOptions(json, &opts))))
+}
+
+func TestPrettyPrefix(t *testing.T) {
+	full := Pretty(example1)
+	lines := bytes.Count(full, []byte{'\n'})
+	for n := 1; n <= lines; n++ {
+		out, consumed := PrettyPrefix(example1, n, nil)
+		if bytes.Count(out, []byte{'\n'}) > n {
+			t.Fatalf("%d: too many lines '%s'", n, out)
+		}
+		if !bytes.HasPrefix(full, out) {
+			t.Fatalf("%d: expected a prefix of the full output, got '%s'", n, out)
+		}
+		if n == lines {
+			assertEqual(t, string(full), string(out))
+			assertEqual(t, len(example1), consumed)
+		}
+	}
+	out, consumed := PrettyPrefix(example1, 4, nil)
+	assertEqual(t, "{\n  \"name\": {\n    \"last\": \"Sanders\",\n    \"first\": \"Janet\"\n", string(out))
+	assertEqual(t, "}, \n\t\"children\"", string(example1[consumed:consumed+15]))
+}
+
+func TestTypeComments(t *testing.T) {
+	json := []byte(`{"a":"x","b":[1,true],"c":{},"d":{"e":null}}`)
+	opts := *DefaultOptions
+	opts.TypeComments = true
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{ /* object */
+  "a": "x" /* string */,
+  "b": [1 /* number */, true /* boolean */] /* array */,
+  "c": {} /* object */,
+  "d": { /* object */
+    "e": null /* null */
+  }
+}
+`, string(out))
+	assertEqual(t, string(json), string(Ugly(Spec(out))))
+}
+
+func TestWidthIgnoresIndent(t *testing.T) {
+	json := []byte(`{"a":{"bbbbbbbb":[1,2,3]}}`)
+	opts := *DefaultOptions
+	opts.Width = 12
+	assertEqual(t, `{
+  "a": {
+    "bbbbbbbb": [
+      1,
+      2,
+      3
+    ]
+  }
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.WidthIgnoresIndent = true
+	assertEqual(t, `{
+  "a": {
+    "bbbbbbbb": [1, 2, 3]
+  }
+}
+`, string(PrettyOptions(json, &opts)))
+}
+
+func TestNoPackedArraySpace(t *testing.T) {
+	json := []byte(`{"a":[10,20,[30,40]],"b":{"c":1,"d":2}}`)
+	opts := *DefaultOptions
+	opts.Width = 24
+	opts.PackLeafObjects = true
+	assertEqual(t, `{
+  "a": [
+    10,
+    20,
+    [30, 40]
+  ],
+  "b": {"c": 1, "d": 2}
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.NoPackedArraySpace = true
+	assertEqual(t, `{
+  "a": [10,20,[30,40]],
+  "b": {"c": 1, "d": 2}
+}
+`, string(PrettyOptions(json, &opts)))
+}
+
+func TestNumberTypeSuffix(t *testing.T) {
+	json := []byte(`{"a":1,"b":[-2,1.0,3e2,1E-2,NaN],"c":"1.5"}`)
+	opts := *DefaultOptions
+	opts.NumberTypeSuffix = true
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  "a": 1 /* int */,
+  "b": [
+    -2 /* int */,
+    1.0 /* float */,
+    3e2 /* float */,
+    1E-2 /* float */,
+    NaN /* float */
+  ],
+  "c": "1.5"
+}
+`, string(out))
+	assertEqual(t, string(json), string(Ugly(Spec(out))))
+}
+
+func TestEscapeSlashes(t *testing.T) {
+	json := []byte(`{"a/b":"</script>","c":"\/","d":"\\/","e":[1,2]}`)
+	opts := *DefaultOptions
+	opts.EscapeSlashes = true
+	assertEqual(t, `{"a\/b":"<\/script>","c":"\/","d":"\\\/","e":[1,2]}`,
+		string(Ugly(PrettyOptions(json, &opts))))
+
+	// the escaped slashes are colored as escapes, like Color would
+	opts.SortKeys = true
+	opts.FixLoneSurrogates = true
+	json = []byte(`{"z":"x\ud800/","a/b":"</script>","c":"\/","d":"\\/","e":[1,2]}`)
+	expect := string(Color(PrettyOptions(json, &opts), nil))
+	opts.Colorize = TerminalStyle
+	assertEqual(t, expect, string(PrettyOptions(json, &opts)))
+	var tokens []string
+	opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+		if kind == TokenKey || kind == TokenString {
+			tokens = append(tokens, string(json[srcStart:srcEnd]))
+		}
+	}
+	PrettyOptions(json, &opts)
+	assertEqual(t, `["a/b" "</script>" "c" "\/" "d" "\\/" "e" "z" "x\ud800/"]`, fmt.Sprint(tokens))
+	opts.Colorize = nil
+	opts.OnToken = nil
+	assertEqual(t, `"\/"`, string(PrettyOptions([]byte(`"/" `), &opts)))
+	assertEqual(t, `"\/`, string(PrettyOptions([]byte(`"/`), &opts)))
+}
+
+func TestInvalidUTF8Strings(t *testing.T) {
+	json := []byte("{\"a\":\"ok\",\"b\xff\":1,\"c\":[\"x\xc3\",\"é\"]}")
+	offsets := InvalidUTF8Strings(json)
+	assertEqual(t, "[10 22]", fmt.Sprint(offsets))
+	opts := *DefaultOptions
+	opts.ReplaceInvalidUTF8 = true
+	assertEqual(t, "{\"a\":\"ok\",\"b�\":1,\"c\":[\"x�\",\"é\"]}",
+		string(Ugly(PrettyOptions(json, &opts))))
+	assertEqual(t, 0, len(InvalidUTF8Strings(PrettyOptions(json, &opts))))
+}
+
+func TestFirstDuplicateKey(t *testing.T) {
+	json := []byte(`{"a":{"b":1,"c":"b"},"d":[{"e":1},{"e":2}],"f":{"g":1,"\u0067":2,"a":3},"a":4}`)
+	key, offset, ok := FirstDuplicateKey(json)
+	assertEqual(t, true, ok)
+	assertEqual(t, "g", key)
+	assertEqual(t, 54, offset)
+	assertEqual(t, `"\u0067"`, string(json[offset:offset+8]))
+	_, offset, ok = FirstDuplicateKey([]byte(`{"a":[{"a":1}],"b":{"a":{"b":2}}}`))
+	assertEqual(t, false, ok)
+	assertEqual(t, -1, offset)
+}
+
+func TestPairColumns(t *testing.T) {
+	json := []byte(`{"rows":[["name","Bob"],["age",42],["occupation","engineer"]],` +
+		`"x":[["a",1]],"y":[["a",1,2],["b",2],["cccccccccccccccccc",1]]}`)
+	opts := *DefaultOptions
+	opts.PairColumns = true
+	opts.Width = 30
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  "rows": [
+    ["name",       "Bob"],
+    ["age",        42],
+    ["occupation", "engineer"]
+  ],
+  "x": [["a", 1]],
+  "y": [
+    ["a", 1, 2],
+    ["b", 2],
+    ["cccccccccccccccccc", 1]
+  ]
+}
+`, string(out))
+	assertEqual(t, string(json), string(Ugly(out)))
+	// without a width, the pairs are always aligned
+	opts.Width = 0
+	assertEqual(t, "[\n  [\"a\",  1],\n  [\"bb\", 2]\n]\n",
+		string(PrettyOptions([]byte(`[["a",1],["bb",2]]`), &opts)))
+	// the pairs are cut at MaxBytes
+	opts.MaxBytes = 60
+	assertEqual(t, "[\n  [\"a\",  1],\n  [\"bb\", 2],\n  [\"c\",  3],\n  ...\n]\n",
+		string(PrettyOptions([]byte(`[["a",1],["bb",2],["c",3],["d",4],["e",5],["f",6]]`), &opts)))
+}
+
+func TestPrettyPrinter(t *testing.T) {
+	var out bytes.Buffer
+	pp := NewPrettyPrinter(&out, nil)
+	enc := json.NewEncoder(pp)
+	enc.Encode(map[string]int{"a": 1})
+	enc.Encode([]int{1, 2})
+	pp.Write([]byte(`{"b":`))
+	if err := pp.Flush(&out); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "{\n  \"a\": 1\n}\n[1, 2]\n", out.String())
+	out.Reset()
+	pp.Write([]byte(`[true]} 12`))
+	pp.Flush(&out)
+	assertEqual(t, "{\n  \"b\": [true]\n}\n", out.String())
+	out.Reset()
+	pp.Write([]byte(`3 "x`))
+	pp.Flush(&out)
+	assertEqual(t, "123\n", out.String())
+	out.Reset()
+	if err := pp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "\"x\n", out.String())
+
+	// without an Output, the input stays pending
+	var zero PrettyPrinter
+	zero.Write([]byte(`[1,2]`))
+	if err := zero.Close(); err == nil {
+		t.Fatal("expected an error")
+	}
+	out.Reset()
+	zero.Output = &out
+	if err := zero.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "[1, 2]\n", out.String())
+}
+
+func TestBuilder(t *testing.T) {
+	var b Builder
+	b.BeginObject()
+	b.Key("name")
+	b.String("Bob \"B\"")
+	b.Key("tags")
+	b.BeginArray()
+	b.String("a")
+	b.RawValue([]byte(`{"x":[1,2]}`))
+	b.EndArray()
+	b.Key("empty")
+	b.BeginObject()
+	b.EndObject()
+	b.Key("n")
+	b.RawValue([]byte(` 1 `))
+	b.EndObject()
+	assertEqual(t, `{
+  "name": "Bob \"B\"",
+  "tags": [
+    "a",
+    {
+      "x": [1, 2]
+    }
+  ],
+  "empty": {},
+  "n": 1
+}
+`, string(b.Bytes()))
+	assertEqual(t, j(`{"name":"Bob \"B\"","tags":["a",{"x":[1,2]}],"empty":{},"n":1}`), j(b.Bytes()))
+	b = Builder{Options: &Options{Prefix: "> ", Indent: "\t"}}
+	b.BeginArray()
+	b.String("x")
+	b.EndArray()
+	assertEqual(t, "> [\n> \t\"x\"\n> ]\n", string(b.Bytes()))
+}
+
+func TestTimeComments(t *testing.T) {
+	json := []byte(`{"a":"2024-01-02T10:04:05+02:00","b":1704204245,"c":1704204245123,` +
+		`"d":123,"e":"2024-01-02","f":99999999999,"g":1704204245.5}`)
+	opts := *DefaultOptions
+	opts.TimeComments = true
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  "a": "2024-01-02T10:04:05+02:00" /* Tue 2024-01-02 08:04:05 UTC */,
+  "b": 1704204245 /* Tue 2024-01-02 14:04:05 UTC */,
+  "c": 1704204245123 /* Tue 2024-01-02 14:04:05.123 UTC */,
+  "d": 123,
+  "e": "2024-01-02",
+  "f": 99999999999,
+  "g": 1704204245.5
+}
+`, string(out))
+	assertEqual(t, string(json), string(Ugly(Spec(out))))
+}
+
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestColorLines(t *testing.T) {
+	data := []byte("{\"a\":1}\n[true]\r\n\n\"partial")
+	var w countingWriter
+	if err := ColorLines(&w, data, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, 4, w.writes)
+	assertEqual(t, string(Color(data, nil)), w.String())
+
+	w.Reset()
+	cw := NewColorWriter(&w, nil)
+	cw.Write([]byte("{\"a\":"))
+	assertEqual(t, 0, w.Len())
+	cw.Write([]byte("1}\n[1"))
+	assertEqual(t, string(Color([]byte("{\"a\":1}\n"), nil)), w.String())
+	cw.Flush()
+	assertEqual(t, string(Color([]byte("{\"a\":1}\n[1"), nil)), w.String())
+}
+
+func TestColorKeysOnly(t *testing.T) {
+	json := []byte(`{"a\"b":["x\ny",1,true,null,{"c\u00e9":{}}]}`)
+	assertEqual(t, `{<"a\"b">:["x\ny",1,true,null,{<"c\u00e9">:{}}]}`,
+		string(ColorKeysOnly(json, [2]string{"<", ">"})))
+	style := &Style{Key: [2]string{"<", ">"}, EscapeWhitespace: true}
+	assertEqual(t, "{<\"a\\tb\">:\"\\n\"}", string(Color([]byte("{\"a\tb\":\"\n\"}"), style)))
+	var w bytes.Buffer
+	ColorReaderWriter(&w, iotest.OneByteReader(bytes.NewReader(json)), style)
+	assertEqual(t, string(Color(json, style)), w.String())
+}
+
+func TestTerminalStyleDimPunct(t *testing.T) {
+	json := []byte(`{"a":[1,"x"],"b":null}`)
+	dim := func(s string) string { return "\x1B[2m" + s + "\x1B[0m" }
+	key := func(s string) string { return "\x1B[1m\x1B[94m" + s + "\x1B[0m" }
+	assertEqual(t, dim("{")+key(`"a"`)+dim(":")+dim("[")+"\x1B[33m1\x1B[0m"+dim(",")+
+		"\x1B[32m\"x\"\x1B[0m"+dim("]")+dim(",")+key(`"b"`)+dim(":")+
+		"\x1B[2mnull\x1B[0m"+dim("}"), string(Color(json, TerminalStyleDimPunct)))
+	opts := *DefaultOptions
+	opts.Colorize = TerminalStyleDimPunct
+	assertEqual(t, string(Color(Pretty(json), TerminalStyleDimPunct)),
+		string(PrettyOptions(json, &opts)))
+	var out bytes.Buffer
+	ColorReaderWriter(&out, iotest.OneByteReader(bytes.NewReader(json)), TerminalStyleDimPunct)
+	assertEqual(t, string(Color(json, TerminalStyleDimPunct)), out.String())
+	// the default style is unchanged, and does not color the commas of
+	// arrays
+	assertEqual(t, "\x1B[1m", TerminalStyle.Brackets[0])
+	assertEqual(t, false, TerminalStyle.ArrayCommas)
+	assertEqual(t, "\x1B[1m[\x1B[0m\x1B[33m1\x1B[0m,\x1B[33m2\x1B[0m\x1B[1m]\x1B[0m",
+		string(Color([]byte(`[1,2]`), nil)))
+	opts.Colorize = TerminalStyle
+	opts.Width = 0
+	assertEqual(t, string(Color([]byte("[\n  1,\n  2\n]\n"), nil)),
+		string(PrettyOptions([]byte(`[1,2]`), &opts)))
+}
+
+func TestColorReaderWriter(t *testing.T) {
+	ws := *TerminalStyle
+	ws.EscapeWhitespace = true
+	for _, json := range []string{
+		`{"a":[1,-2.5e3,true,false,null],"b\"c":"d\u00e9\n\\"}`,
+		"{\"a\":\"x\ty\"}\n[nan, n, Inf, {\"k\":{}}]",
+		`{"a":"unterminated \u00`,
+		`[1,2`,
+		string(example1), example2, string(example3),
+	} {
+		for _, style := range []*Style{nil, &ws} {
+			var w bytes.Buffer
+			err := ColorReaderWriter(&w,
+				iotest.OneByteReader(strings.NewReader(json)), style)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, string(Color([]byte(json), style)), w.String())
+			w.Reset()
+			ColorReaderWriter(&w, strings.NewReader(json), style)
+			assertEqual(t, string(Color([]byte(json), style)), w.String())
+		}
+	}
+	err := ColorReaderWriter(io.Discard, iotest.ErrReader(io.ErrUnexpectedEOF), nil)
+	assertEqual(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestSortPackOrder(t *testing.T) {
+	opts := *DefaultOptions
+	opts.PackLeafObjects = true
+	opts.SortKeys = true
+	opts.Width = 30
+	// 29 columns when packed, which fits in a Width of 30, in any order
+	for _, json := range []string{
+		`[{"ccc":1,"bb":2,"a":3}]`,
+		`[{"a":3,"bb":2,"ccc":1}]`,
+		`[{"bb":2,"a":3,"ccc":1}]`,
+	} {
+		out := string(PrettyOptions([]byte(json), &opts))
+		assertEqual(t, "[\n  {\"a\": 3, \"bb\": 2, \"ccc\": 1}\n]\n", out)
+	}
+	opts.Width = 29
+	out := string(PrettyOptions([]byte(`[{"ccc":1,"bb":2,"a":3}]`), &opts))
+	assertEqual(t, "[\n  {\n    \"a\": 3,\n    \"bb\": 2,\n    \"ccc\": 1\n  }\n]\n", out)
+	// every order of the keys is packed the same way at every width
+	members := []string{`"ccc":1`, `"bb":2`, `"a":3`}
+	for width := 0; width < 40; width++ {
+		opts.Width = width
+		expect := string(PrettyOptions([]byte(`[{"a":3,"bb":2,"ccc":1}]`), &opts))
+		for _, p := range [][3]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0},
+			{2, 0, 1}, {2, 1, 0}} {
+			json := "[{" + members[p[0]] + "," + members[p[1]] + "," +
+				members[p[2]] + "}]"
+			assertEqual(t, expect, string(PrettyOptions([]byte(json), &opts)))
+		}
+	}
+
+	// the tokens follow the sorted keys
+	opts.Width = 80
+	json := []byte(`{"b":[{"y":1,"x":2}],"a":true}`)
+	var keys []string
+	opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+		if kind == TokenKey {
+			keys = append(keys, string(json[srcStart:srcEnd]))
+		}
+	}
+	out = string(PrettyOptions(json, &opts))
+	assertEqual(t, "{\n  \"a\": true,\n  \"b\": [\n    {\"x\": 2, \"y\": 1}\n  ]\n}\n", out)
+	assertEqual(t, `["a" "b" "x" "y"]`, fmt.Sprint(keys))
+
+	// only the root object is sorted
+	opts.OnToken = nil
+	opts.SortKeys = false
+	opts.SortKeysTopLevelOnly = true
+	out = string(PrettyOptions(json, &opts))
+	assertEqual(t, "{\n  \"a\": true,\n  \"b\": [\n    {\"y\": 1, \"x\": 2}\n  ]\n}\n", out)
+}
+
+func TestEscapedString(t *testing.T) {
+	for _, s := range []string{
+		"", "hello", "a\"b\\c", "tab\tnl\nret\r", "\x00\x01\x1f\x7f", "héllo 世界",
+		"line\u2028sep\u2029", "bad\xffutf8",
+	} {
+		var str string
+		if err := json.Unmarshal(EscapedString(s), &str); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, strings.ToValidUTF8(s, "�"), str)
+	}
+	assertEqual(t, `"a\"b\\c\n\u0001\u2028"`, string(EscapedString("a\"b\\c\n\x01\u2028")))
+	assertEqual(t, `x:"y"`, string(AppendEscapedString([]byte("x:"), "y")))
+}
+
+func TestGroupByType(t *testing.T) {
+	json := []byte(`{"s":"x","o":{"b":[1],"a":2},"n":1,"z":null,"a":"y","t":true,"m":0}`)
+	opts := *DefaultOptions
+	opts.GroupByType = true
+	assertEqual(t, `{"z":null,"n":1,"m":0,"s":"x","a":"y","t":true,"o":{"a":2,"b":[1]}}`,
+		string(Ugly(PrettyOptions(json, &opts))))
+	opts.SortKeys = true
+	assertEqual(t, `{"z":null,"m":0,"n":1,"a":"y","s":"x","t":true,"o":{"a":2,"b":[1]}}`,
+		string(Ugly(PrettyOptions(json, &opts))))
+	expect := Color(PrettyOptions(json, &opts), nil)
+	opts.Colorize = TerminalStyle
+	assertEqual(t, string(expect), string(PrettyOptions(json, &opts)))
+}
+
+func TestPresetOptions(t *testing.T) {
+	json := []byte(`{"b":[1,2],"a":{"x":1}}`)
+	assertEqual(t, "{\n  \"b\": [1, 2],\n  \"a\": {\"x\": 1}\n}\n",
+		string(PrettyOptions(json, CompactOptions())))
+	assertEqual(t, "{\n    \"b\": [1, 2],\n    \"a\": {\n        \"x\": 1\n    }\n}\n",
+		string(PrettyOptions(json, ReadableOptions())))
+	assertEqual(t, "{\n  \"a\": {\n    \"x\": 1\n  },\n  \"b\": [\n    1,\n    2\n  ]\n}\n",
+		string(PrettyOptions(json, DiffOptions())))
+	if CompactOptions() == CompactOptions() {
+		t.Fatal("expected new options")
+	}
+}
+
+func TestMaxKeyLength(t *testing.T) {
+	json := []byte(`{"abcdefgh":1,"abcd":2,"éé\né\"":3,"abcdefga":4}`)
+	opts := *DefaultOptions
+	opts.MaxKeyLength = 4
+	opts.SortKeys = true
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{"abcd":2,"abcd...":4,"abcd...":1,"éé\né...":3}`, string(Ugly(out)))
+	opts.Colorize = TerminalStyle
+	assertEqual(t, string(Color(out, nil)), string(PrettyOptions(json, &opts)))
+}
+
+func TestBlankLineBetweenEntries(t *testing.T) {
+	json := []byte(`{"b":{"x":1,"y":2},"a":[1,2],"c":3}`)
+	opts := *DefaultOptions
+	opts.BlankLineBetweenEntries = true
+	assertEqual(t, `{
+  "b": {
+    "x": 1,
+    "y": 2
+  },
+
+  "a": [1, 2],
+
+  "c": 3
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.SortKeys = true
+	assertEqual(t, `{
+  "a": [1, 2],
+
+  "b": {
+    "x": 1,
+    "y": 2
+  },
+
+  "c": 3
+}
+`, string(PrettyOptions(json, &opts)))
+	assertEqual(t, "[\n  {\n    \"a\": 1,\n    \"b\": 2\n  }\n]\n",
+		string(PrettyOptions([]byte(`[{"a":1,"b":2}]`), &opts)))
+}
+
+func TestMaxConsecutiveBlankLines(t *testing.T) {
+	json := []byte("{\"a\":1,\n/* x\n\n\n\ny */\n\"b\":2}")
+	opts := *DefaultOptions
+	opts.PreserveComments = true
+	opts.BlankLineBetweenEntries = true
+	opts.MaxConsecutiveBlankLines = 1
+	var keys [][2]int
+	opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+		if kind == TokenKey {
+			keys = append(keys, [2]int{dstStart, dstEnd})
+		}
+	}
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, "{\n  \"a\": 1,\n\n  /* x\n\ny */\n  \"b\": 2\n}\n", string(out))
+	assertEqual(t, `"b"`, string(out[keys[1][0]:keys[1][1]]))
+}
+
+func TestMerge(t *testing.T) {
+	base := []byte(`{"name":"app","port":8080,"tls":{"enabled":false,"cert":"a.pem"},
+		"hosts":["a","b"],"ratio":1.50}`)
+	override := []byte(`{"port":9090,"tls":{"enabled":true},"hosts":["c"],"debug":true}`)
+	out := Merge(base, override, nil)
+	assertEqual(t, `{"name":"app","port":9090,"tls":{"enabled":true,"cert":"a.pem"},`+
+		`"hosts":["c"],"ratio":1.50,"debug":true}`, string(Ugly(out)))
+	assertEqual(t, "[1]", string(Merge(base, []byte(` [1] `), nil)))
+	assertEqual(t, string(Pretty(base)), string(Merge(base, nil, nil)))
+	assertEqual(t, `{"a":1}`, string(Ugly(Merge([]byte(`{}`), []byte(`{"a":1}`), nil))))
+}
+
+func TestNoTrailingSpace(t *testing.T) {
+	opts := *DefaultOptions
+	opts.FillArrays = true
+	opts.Width = 16
+	out := PrettyOptions([]byte(`{"b":[111,222,333,444]}`), &opts)
+	assertEqual(t, "{\n  \"b\": [\n    111, 222,\n    333, 444\n  ]\n}\n",
+		string(out))
+	opts.PreserveComments = true
+	out = PrettyOptions([]byte("[1,  // one  \n 2 /* two */  ]  // end  "), &opts)
+	assertEqual(t, "[\n  1,\n  // one\n  2\n  /* two */\n]\n// end\n", string(out))
+	opts.TrimLineTrailingSpace = false
+	out = PrettyOptions([]byte("[1,  // one  \n 2 /* two */  ]  // end  "), &opts)
+	assertEqual(t, "[\n  1, \n  // one\n  2\n  /* two */\n]\n// end\n", string(out))
+	for _, opts := range []*Options{CompactOptions(), ReadableOptions(),
+		DiffOptions()} {
+		assertEqual(t, true, opts.TrimLineTrailingSpace)
+	}
+}
+
+func TestBracketGlyphs(t *testing.T) {
+	style := &Style{Glyphs: &BracketGlyphs{"⟨", "⟩", "⟦", "⟧"}}
+	json := []byte(`{"a":[1,2],"b":{}}`)
+	assertEqual(t, `⟨"a":⟦1,2⟧,"b":⟨⟩⟩`, string(Color(json, style)))
+	opts := *DefaultOptions
+	opts.Colorize = style
+	opts.Width = 14
+	assertEqual(t, "⟨\n  \"a\": ⟦1, 2⟧,\n  \"b\": ⟨⟩\n⟩\n", string(PrettyOptions(json, &opts)))
+}
+
+func TestTabWidth(t *testing.T) {
+	opts := *DefaultOptions
+	opts.Indent = "\t"
+	opts.TabWidth = 4
+	json := []byte(`{"a":{"b":[1,2]}}`)
+	assertEqual(t, "{\n    \"a\": {\n        \"b\": [1, 2]\n    }\n}\n",
+		string(PrettyOptions(json, &opts)))
+	opts.TabWidth = 0
+	assertEqual(t, "{\n\t\"a\": {\n\t\t\"b\": [1, 2]\n\t}\n}\n",
+		string(PrettyOptions(json, &opts)))
+}
+
+func TestRawPaths(t *testing.T) {
+	json := []byte(`{"a":{"keep":[1,  2,
+	3],"b":[ 1 ]},"items":[{"x" : 1},{"x":  {"y":2}}],"s":"x"}`)
+	opts := *DefaultOptions
+	opts.RawPaths = []string{"a.keep", "items.1.x"}
+	assertEqual(t, `{
+  "a": {
+    "keep": [1,  2,
+	3],
+    "b": [1]
+  },
+  "items": [
+    {
+      "x": 1
+    },
+    {
+      "x": {"y":2}
+    }
+  ],
+  "s": "x"
+}
+`, string(PrettyOptions(json, &opts)))
+
+	// the raw values are colored like Color would
+	for _, width := range []int{0, 20, 22, 80} {
+		opts.Width = width
+		opts.Colorize = nil
+		expect := string(Color(PrettyOptions(json, &opts), nil))
+		opts.Colorize = TerminalStyle
+		assertEqual(t, expect, string(PrettyOptions(json, &opts)))
+	}
+	opts.Colorize = nil
+	json = []byte(`{"a":[{"b":[1,2]},3],"c":"x"}`)
+	opts.RawPaths = []string{"a.0", "c"}
+	expect := string(Color(PrettyOptions(json, &opts), nil))
+	opts.Colorize = TerminalStyle
+	assertEqual(t, expect, string(PrettyOptions(json, &opts)))
+}
+
+func TestValidReader(t *testing.T) {
+	for _, json := range []string{
+		`{"a":[1,-2.5e+3,true,false,null,"xé\n"],"b":{}}`, ` [] `, `0`,
+		``, ` `, `{`, `{"a"`, `{"a":}`, `[1,]`, `{"a":1,}`, `[01]`, `[1.]`,
+		`[1e]`, `-`, `tru`, `nul `, `"a\x"`, `"\u12G4"`, "\"a\nb\"", `{} {}`,
+		`[1 2]`, `{"a" 1}`, `{1:2}`, `[-a]`, `1.5e`, "\x00{}", "[1,\x012]",
+		"\t[\r\n1 ]",
+	} {
+		_, expect := UglyStrict([]byte(json))
+		for _, r := range []io.Reader{
+			strings.NewReader(json), iotest.OneByteReader(strings.NewReader(json)),
+		} {
+			err := ValidReader(r)
+			if fmt.Sprint(err) != fmt.Sprint(expect) {
+				t.Fatalf("%q: expected %v, got %v", json, expect, err)
+			}
+		}
+	}
+	err := ValidReader(iotest.ErrReader(io.ErrUnexpectedEOF))
+	assertEqual(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestCompact(t *testing.T) {
+	json := []byte(`{ "a" : 1,
+	"b" : [ 1 , 2 ], "c, d": "e: f\"", "g" : {} }`)
+	assertEqual(t, `{"a": 1, "b": [1, 2], "c, d": "e: f\"", "g": {}}`, string(Compact(json)))
+	assertEqual(t, "", string(Compact(nil)))
+}
+
+func TestRenderEscapedNewlines(t *testing.T) {
+	json := []byte(`{"a":"one\ntwo\nthree","b":["x\ny","z\n"],"c":"\\n"}`)
+	opts := *DefaultOptions
+	opts.RenderEscapedNewlines = true
+	assertEqual(t, `{
+  "a": "one\n↩
+    two\n↩
+    three",
+  "b": [
+    "x\n↩
+      y",
+    "z\n"
+  ],
+  "c": "\\n"
+}
+`, string(PrettyOptions(json, &opts)))
+}
+
+func TestExpandEmbeddedJSON(t *testing.T) {
+	json := []byte(`{"a":"{\"b\":[1,2],\"c\":\"[3]\"}","d":"[x]","e":" [4] ","f":"{"}`)
+	opts := *DefaultOptions
+	opts.ExpandEmbeddedJSON = true
+	assertEqual(t, `{
+  "a": {
+    "b": [1, 2],
+    "c": [3]
+  },
+  "d": "[x]",
+  "e": [4],
+  "f": "{"
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.MaxNestingDepth = 1
+	// the expanded documents are nested
+	assertEqual(t, `{
+  "a": { 2 keys },
+  "d": "[x]",
+  "e": [ 1 element ],
+  "f": "{"
+}
+`, string(PrettyOptions(json, &opts)))
+}
+
+func TestCollapseLargeLeaves(t *testing.T) {
+	big := strings.Repeat("x", 8400)
+	json := []byte(`{"a":"` + big + `","b":1234567,"c":"short","d":true,"e":[123456789012]}`)
+	opts := *DefaultOptions
+	opts.CollapseLargeLeaves = 6
+	assertEqual(t, `{
+  "a": "<8.2 KB>",
+  "b": "<7 B>",
+  "c": "<7 B>",
+  "d": true,
+  "e": ["<12 B>"]
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.CollapseLargeLeaves = 7
+	assertEqual(t, `{"a":"<8.2 KB>","b":1234567,"c":"short","d":true,"e":["<12 B>"]}`,
+		string(Ugly(PrettyOptions(json, &opts))))
+}
+
+func TestSortArraysByKey(t *testing.T) {
+	json := []byte(`{"a":[{"id":3,"n":"c"},{"n":"x"},{"id":1,"n":"a"},{"id":"2"},{"id":2}],` +
+		`"b":[{"id":2},1,{"id":1}],"c":[{"id":"b"},{"id":"a"}]}`)
+	opts := *DefaultOptions
+	opts.SortArraysByKey = "id"
+	var tokens []string
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{"a":[{"id":1,"n":"a"},{"id":2},{"id":3,"n":"c"},{"id":"2"},{"n":"x"}],`+
+		`"b":[{"id":2},1,{"id":1}],"c":[{"id":"a"},{"id":"b"}]}`, string(Ugly(out)))
+	opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+		if kind == TokenString {
+			tokens = append(tokens, string(out[dstStart:dstEnd]))
+		}
+	}
+	out = PrettyOptions(json, &opts)
+	assertEqual(t, `["a" "c" "2" "x" "a" "b"]`, fmt.Sprint(tokens))
+}
+
+func TestPrettyLen(t *testing.T) {
+	opts := *DefaultOptions
+	for _, json := range [][]byte{example1, []byte(example2), nil, []byte(`[1,2]`),
+		[]byte("[1,\n[2, {\"a\": 3"), []byte("// c\n{\"a\":[1, /* b */ 2],\"c\":\"\\n\"}")} {
+		for _, sortKeys := range []bool{false, true} {
+			opts.SortKeys = sortKeys
+			assertEqual(t, len(PrettyOptions(json, &opts)), PrettyLen(json, &opts))
+		}
+		opts := *DefaultOptions
+		opts.PreserveComments = true
+		opts.RenderEscapedNewlines = true
+		opts.TrimLineTrailingSpace = true
+		opts.ValueFormatter = func(path string, raw []byte, t TokenKind) ([]byte, bool) {
+			return []byte("<\n>"), path == "a.1"
+		}
+		assertEqual(t, len(PrettyOptions(json, &opts)), PrettyLen(json, &opts))
+	}
+	assertEqual(t, len(Pretty(example1)), PrettyLen(example1, nil))
+	// the finished lines are not kept
+	json := []byte(`[` + strings.Repeat(`{"a":[1,2]},`, 1000) + `{}]`)
+	st := &prettyState{opts: DefaultOptions, count: true}
+	buf := prettyOptions(json, st)
+	assertEqual(t, "[  {}\n]\n", string(buf))
+	assertEqual(t, len(Pretty(json)), st.flushed+len(buf))
+}
+
+func TestPointerGutter(t *testing.T) {
+	json := []byte(`{"users":[{"name":"Bob","a/b~":[1,2],"deep":{"x":[{"y":1},2]}}],"e":[]}`)
+	opts := *DefaultOptions
+	opts.PointerGutter = true
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  "users": [ /* /users */
+    { /* /users/0 */
+      "name": "Bob" /* /users/0/name */,
+      "a/b~": [1, 2] /* /users/0/a~1b~0 */,
+      "deep": { /* /users/0/deep */
+        "x": [ /* /users/0/deep/x */
+          { /* /users/0/deep/x/0 */
+            "y": 1 /* /users/0/deep/x/0/y */
+          },
+          2 /* /users/0/deep/x/1 */
+        ]
+      }
+    }
+  ],
+  "e": [] /* /e */
+}
+`, string(out))
+	assertEqual(t, string(Ugly(json)), string(Ugly(Spec(out))))
+	assertEqual(t, "[1, 2]", string(PrettyOptions([]byte(`[1,2]`), &opts)))
+}
+
+func TestAnchorComments(t *testing.T) {
+	json := []byte(`{"users":[{"name":"Bob","a/b":[1,2]}],"e":[]}`)
+	opts := *DefaultOptions
+	opts.AnchorComments = true
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  "users": [ /* /users */
+    { /* /users/0 */
+      "name": "Bob", /* /users/0/name */
+      "a/b": [1, 2] /* /users/0/a~1b */
+    } /* /users/0 */
+  ], /* /users */
+  "e": [] /* /e */
+}
+`, string(out))
+	assertEqual(t, string(Ugly(json)), string(Ugly(Spec(out))))
+	assertEqual(t, string(Pretty(json)), string(Pretty(out)))
+	assertEqual(t, string(Pretty(json)), string(Pretty(Ugly(out))))
+	opts.SortKeys = true
+	opts.PreserveComments = true
+	out = PrettyOptions([]byte(`{"b":[1,2],/* c */"a":true}`), &opts)
+	assertEqual(t, `{
+  /* c */
+  "a": true, /* /a */
+  "b": [1, 2] /* /b */
+}
+`, string(out))
+	assertEqual(t, "[1, 2]", string(PrettyOptions([]byte(`[1,2]`), &opts)))
+}
+
+func TestBracketMatchComments(t *testing.T) {
+	json := []byte(`{"user":{"tags":[1,{"a":[2,{"b":3}]},[[4,5,6,7,8,9,10,11,12,13]]],"e":{}}}`)
+	opts := *DefaultOptions
+	opts.BracketMatchComments = true
+	opts.Width = 20
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  "user": {
+    "tags": [
+      1,
+      {
+        "a": [
+          2,
+          {
+            "b": 3
+          } /* a[1] */
+        ] /* a */
+      }, /* tags[1] */
+      [
+        [
+          4,
+          5,
+          6,
+          7,
+          8,
+          9,
+          10,
+          11,
+          12,
+          13
+        ] /* tags[2][0] */
+      ] /* tags[2] */
+    ], /* tags */
+    "e": {}
+  } /* user */
+}
+`, string(out))
+	assertEqual(t, string(Ugly(json)), string(Ugly(Spec(out))))
+	assertEqual(t, string(Pretty(json)), string(Pretty(out)))
+	assertEqual(t, string(Pretty(json)), string(Pretty(Ugly(out))))
+	json = []byte(`{"a*/b":{"c":1}}`)
+	out = PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  "a*/b": {
+    "c": 1
+  } /* a*\/b */
+}
+`, string(out))
+	assertEqual(t, string(Pretty(json)), string(Pretty(Ugly(out))))
+}
+
+func TestDisplayQuote(t *testing.T) {
+	json := []byte(`{"it's":["say \"hi\"","a\\",1],"k":"\u0027"}`)
+	opts := *DefaultOptions
+	opts.DisplayQuote = '\''
+	assertEqual(t, `{
+  'it\'s': ['say "hi"', 'a\\', 1],
+  'k': '\u0027'
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.Colorize = TerminalStyle
+	opts.UnquoteSafeKeys = true
+	out := string(PrettyOptions(json, &opts))
+	assertEqual(t, true, strings.Contains(out, "\x1b[94m'it\\'s'\x1b[0m"))
+	assertEqual(t, true, strings.Contains(out, "\x1b[94mk\x1b[0m"))
+	opts.DisplayQuote = '"'
+	opts.Colorize = nil
+	opts.UnquoteSafeKeys = false
+	assertEqual(t, string(Pretty(json)), string(PrettyOptions(json, &opts)))
+}
+
+func TestFixLoneSurrogates(t *testing.T) {
+	json := []byte(`{"k\uDC00":["\uD83D\uDE00","\uD800x","a\uDBFF\u0041",` +
+		`"\\uD800","\ud800\udc00\udc00","\uD800"]}`)
+	opts := *DefaultOptions
+	opts.FixLoneSurrogates = true
+	assertEqual(t, `{"k\uFFFD":["\uD83D\uDE00","\uFFFDx","a\uFFFD\u0041",`+
+		`"\\uD800","\ud800\udc00\uFFFD","\uFFFD"]}`,
+		string(Ugly(PrettyOptions(json, &opts))))
+	out := PrettyOptions(json, &opts)
+	opts.Colorize = TerminalStyle
+	assertEqual(t, string(Color(out, TerminalStyle)),
+		string(PrettyOptions(json, &opts)))
+}
+
+func TestUnquoteSafeKeys(t *testing.T) {
+	json := []byte(`{"name":"x","_id$2":1,"2a":2,"a-b":3,"class":4,"":5,"\u0061":6,"nested":{"ok":true}}`)
+	opts := *DefaultOptions
+	opts.UnquoteSafeKeys = true
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  name: "x",
+  _id$2: 1,
+  "2a": 2,
+  "a-b": 3,
+  "class": 4,
+  "": 5,
+  "\u0061": 6,
+  nested: {
+    ok: true
+  }
+}
+`, string(out))
+	opts.Colorize = TerminalStyle
+	assertEqual(t, "\x1b[1m{\x1b[0m\n  \x1b[1m\x1b[94mname\x1b[0m\x1b[1m:\x1b[0m",
+		string(PrettyOptions(json, &opts))[:38])
+}
+
+func TestColorAppend(t *testing.T) {
+	dst := []byte("> ")
+	dst = ColorAppend(dst, example1, nil)
+	assertEqual(t, "> "+string(Color(example1, nil)), string(dst))
+	dst = ColorAppend(dst[:0], []byte(`{"a":[1,{"b":true}]}`), TerminalStyle)
+	allocs := testing.AllocsPerRun(100, func() {
+		dst = ColorAppend(dst[:0], []byte(`{"a":[1,{"b":true}]}`), TerminalStyle)
+	})
+	assertEqual(t, 0.0, allocs)
+}
+
+func BenchmarkColorAppend(t *testing.B) {
+	var dst []byte
+	t.ReportAllocs()
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		dst = ColorAppend(dst[:0], example1, nil)
+	}
+}
+
+func TestGoStringLiteral(t *testing.T) {
+	json := []byte(`{"a":"b","c":[1,2]}`)
+	assertEqual(t, "`{\n  \"a\": \"b\",\n  \"c\": [1, 2]\n}\n`",
+		string(GoStringLiteral(json, nil, true)))
+	assertEqual(t, `"{\n  \"a\": \"b\",\n  \"c\": [1, 2]\n}\n"`,
+		string(GoStringLiteral(json, nil, false)))
+	assertEqual(t, `"{\n  \"a\": \"`+"`"+`\"\n}\n"`,
+		string(GoStringLiteral([]byte(`{"a":"`+"`"+`"}`), nil, true)))
+	assertEqual(t, `"[\"\r\"]"`,
+		string(GoStringLiteral([]byte("[\"\r\"]"), nil, true)))
+}
+
+func TestTreeGuides(t *testing.T) {
+	json := []byte(`{"users":[{"name":"Bob","deep":{"x":[{"y":1},2]}},{"name":"Al"}],"e":[],"z":{"q":"r"}}`)
+	opts := *DefaultOptions
+	opts.TreeGuides = true
+	assertEqual(t, `{
+├─"users": [
+│ ├─{
+│ │ ├─"name": "Bob",
+│ │ └─"deep": {
+│ │   └─"x": [
+│ │     ├─{
+│ │     │ └─"y": 1
+│ │     │ },
+│ │     └─2
+│ │     ]
+│ │   }
+│ │ },
+│ └─{
+│   └─"name": "Al"
+│   }
+│ ],
+├─"e": [],
+└─"z": {
+  └─"q": "r"
+  }
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.Indent = "    "
+	opts.Prefix = "> "
+	opts.SortKeys = true
+	assertEqual(t, `> {
+> ├── "a": [1],
+> └── "b": {
+>     └── "c": 1
+>     }
+> }
+`, string(PrettyOptions([]byte(`{"b":{"c":1},"a":[1]}`), &opts)))
+	opts.ASCIIGuides = true
+	opts.Prefix = ""
+	assertEqual(t, "{\n+-- \"a\": {\n|   `-- \"c\": 1\n|   },\n`-- \"b\": 2\n}\n",
+		string(PrettyOptions([]byte(`{"b":2,"a":{"c":1}}`), &opts)))
+
+	// the tokens are moved along with the guides
+	tokens := func(opts *Options) []string {
+		var ranges [][2]int
+		opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+			if kind != TokenObject && kind != TokenArray {
+				ranges = append(ranges, [2]int{dstStart, dstEnd})
+			}
+		}
+		out := PrettyOptions(example1, opts)
+		var tokens []string
+		for _, r := range ranges {
+			tokens = append(tokens, string(out[r[0]:r[1]]))
+		}
+		return tokens
+	}
+	opts = *DefaultOptions
+	opts.SortKeys = true
+	want := tokens(&opts)
+	opts.TreeGuides = true
+	assertEqual(t, fmt.Sprint(want), fmt.Sprint(tokens(&opts)))
+}
+
+func TestMaxDepth(t *testing.T) {
+	json := []byte(`{"users":[{"name":"Bob","deep":{"x":[{"y":1},2]}},{"name":"Al"}],` +
+		`"e":[],"z":{"q":"r","s":"}"},"w":[1,]}`)
+	opts := *DefaultOptions
+	opts.MaxDepth = 1
+	assertEqual(t, `{
+  "users": [ 2 elements ],
+  "e": [],
+  "z": { 2 keys },
+  "w": [ 1 element ]
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.MaxDepth = 3
+	assertEqual(t, `{
+  "users": [
+    {
+      "name": "Bob",
+      "deep": { 1 key }
+    },
+    {
+      "name": "Al"
+    }
+  ],
+  "e": [],
+  "z": {
+    "q": "r",
+    "s": "}"
+  },
+  "w": [1]
+}
+`, string(PrettyOptions(json, &opts)))
+	out := PrettyOptions(json, &opts)
+	opts.Colorize = TerminalStyle
+	assertEqual(t, string(Color(out, nil)), string(PrettyOptions(json, &opts)))
+}
+
+func TestMaxNestingDepth(t *testing.T) {
+	opts := *DefaultOptions
+	opts.MaxNestingDepth = 2
+	assertEqual(t, `{
+  "a": [{ 2 keys }, 1]
+}
+`, string(PrettyOptions([]byte(`{"a":[{"b":[[]],"c":1},1]}`), &opts)))
+	opts.MaxNestingDepth = -1
+	assertEqual(t, string(Pretty([]byte(`[[[1]]]`))),
+		string(PrettyOptions([]byte(`[[[1]]]`), &opts)))
+
+	// the default limit
+	json := []byte(strings.Repeat("[", 10002) + strings.Repeat("]", 10002))
+	opts.MaxNestingDepth = 0
+	opts.Indent = ""
+	opts.Width = 0
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, 10001, bytes.Count(out, []byte("[")))
+	assertEqual(t, 1, bytes.Count(out, []byte("[ 1 element ]")))
+}
+
+func TestNumberNotation(t *testing.T) {
+	json := []byte(`[1e10,1E10,10000000000,0.00001,-2.5e-3,12345678901234567890,1e400,NaN,7]`)
+	opts := *DefaultOptions
+	assertEqual(t, string(Ugly(json)), string(Ugly(PrettyOptions(json, &opts))))
+	opts.NumberNotation = NotationDecimal
+	assertEqual(t, `[10000000000,10000000000,10000000000,0.00001,-0.0025,`+
+		`12345678901234567890,1e400,NaN,7]`, string(Ugly(PrettyOptions(json, &opts))))
+	opts.NumberNotation = NotationScientific
+	assertEqual(t, `[1e+10,1e+10,1e+10,1e-05,-2.5e-03,`+
+		`12345678901234567890,1e400,NaN,7e+00]`, string(Ugly(PrettyOptions(json, &opts))))
+	opts.NumberNotation = NotationDecimal
+	opts.GroupDigits = true
+	assertEqual(t, `[10,000,000,000, 2,500.5]`,
+		string(PrettyOptions([]byte(`[1e10,2.5005e3]`), &opts)))
+}
+
+func TestNormalizeSigns(t *testing.T) {
+	opts := *DefaultOptions
+	opts.NormalizeSigns = true
+	for _, tc := range [][2]string{
+		{"-0", "0"},
+		{"-0.0", "0.0"},
+		{"-0.000e-5", "0.000e-5"},
+		{"-0.01", "-0.01"},
+		{"+5", "5"},
+		{"+0", "0"},
+		{"007", "7"},
+		{"-007", "-7"},
+		{"-000", "0"},
+		{"00.5e+01", "0.5e+01"},
+		{"-00.5", "-0.5"},
+		{"10.05", "10.05"},
+		{"1e007", "1e007"},
+		{"-Inf", "-Inf"},
+		{"+Inf", "+Inf"},
+		{"NaN", "NaN"},
+	} {
+		out := PrettyOptions([]byte(tc[0]), &opts)
+		assertEqual(t, tc[1], string(out))
+	}
+	opts.NumberNotation = NotationDecimal
+	assertEqual(t, "[0,7,50]", string(Ugly(PrettyOptions([]byte(`[-0,+007,+5e1]`), &opts))))
+}
+
+func TestDisplayWidth(t *testing.T) {
+	for _, tc := range []struct {
+		s string
+		w int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"é", 1},                  // precomposed
+		{"e\u0301", 1},            // combining acute accent
+		{"a\u20dd", 1},            // enclosing circle
+		{"中文", 4},                 // CJK ideographs
+		{"한글", 4},                 // hangul syllables
+		{"\u1100\u1161\u11a8", 2}, // hangul jamo, leading is wide
+		{"ｱ", 1},                  // halfwidth katakana
+		{"Ａ", 2},                  // fullwidth latin
+		{"、", 2},                  // ideographic comma
+		{"😀", 2},                  // emoji
+		{"👍🏽", 2},                 // emoji with a skin tone modifier
+		{"👩\u200d💻", 4},           // zero width joiner
+		{"🇯🇵", 2},                 // regional indicators
+		{"\u200b", 0},             // zero width space
+		{"\ufeff", 0},             // byte order mark
+		{"\ufe0f", 0},             // variation selector
+		{"\t", 8},
+		{"a\tb", 10},
+		{"\x1b", 0},
+		{"\n", 0},
+		{"\u0085", 0}, // C1 control
+		{"\xff\xfe", 2},
+		{"★", 1}, // ambiguous width is narrow
+		{"→", 1},
+		{"\U00020000", 2}, // CJK extension B
+	} {
+		if w := DisplayWidth([]byte(tc.s)); w != tc.w {
+			t.Errorf("%q: expected %d, got %d", tc.s, tc.w, w)
+		}
+	}
+	// the DefaultOptions do not change the width of a tab
+	tab := DefaultOptions.TabWidth
+	DefaultOptions.TabWidth = 4
+	defer func() { DefaultOptions.TabWidth = tab }()
+	assertEqual(t, 9, DisplayWidth([]byte("\ta")))
+}
+
+func TestHardWrap(t *testing.T) {
+	json := []byte(`{"name":"abc\u00e9def é","list":[1,2,3,4,5,6,7,8,9,10,11,12]}`)
+	opts := *DefaultOptions
+	opts.HardWrap = 16
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  "name": "abc
+    \u00e9def é"
+    ,
+  "list": [1, 2,
+     3, 4, 5, 6,
+     7, 8, 9, 10
+    , 11, 12]
+}
+`, string(out))
+	var tokens [][2]int
+	opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+		if kind == TokenKey || kind == TokenString {
+			tokens = append(tokens, [2]int{dstStart, dstEnd})
+		}
+	}
+	PrettyOptions(json, &opts)
+	var strs []string
+	for _, tok := range tokens {
+		strs = append(strs, string(out[tok[0]:tok[1]]))
+	}
+	assertEqual(t, "\"name\",\"abc\n    \\u00e9def é\",\"list\"", strings.Join(strs, ","))
+
+	// wide characters are two columns
+	opts.OnToken = nil
+	opts.HardWrap = 10
+	assertEqual(t, "[\"中文中文\n  \"]", string(PrettyOptions([]byte(`["中文中文"]`), &opts)))
+
+	// tabs are TabWidth columns
+	opts.HardWrap = 12
+	opts.PreserveComments = true
+	json = []byte("[1, /*\tab\tcd*/ 2]")
+	assertEqual(t, "[\n  1,\n  /*\t\n    ab\n    \t\n    cd*/\n  2\n]\n",
+		string(PrettyOptions(json, &opts)))
+	opts.TabWidth = 2
+	assertEqual(t, "[\n  1,\n  /*\tab\tcd\n    */\n  2\n]\n",
+		string(PrettyOptions(json, &opts)))
+}
+
+func TestStrings(t *testing.T) {
+	json := []byte(`{"a":"x","b":["y\n",1,{"c":"z\u0041"}],"d":true}`)
+	assertEqual(t, `["x" "y\n" "zA"]`, fmt.Sprintf("%q", Strings(json, false)))
+	assertEqual(t, `["a" "x" "b" "y\n" "c" "zA" "d"]`, fmt.Sprintf("%q", Strings(json, true)))
+	assertEqual(t, 0, len(Strings([]byte(`[1,null]`), true)))
+}
+
+func TestDefaultValueStyles(t *testing.T) {
+	style := *TerminalStyle
+	json := []byte(`{"":"","a":0,"b":-0.0e5,"c":false,"d":0.1,"e":"x","f":true}`)
+	assertEqual(t, string(Color(json, TerminalStyle)), string(Color(json, &style)))
+	style.EmptyString = [2]string{"<e>", "</e>"}
+	style.Zero = [2]string{"<z>", "</z>"}
+	style.FalseEmphasis = [2]string{"<f>", "</f>"}
+	plain := style
+	plain.Key = [2]string{"<k>", "</k>"}
+	plain.String = [2]string{"<s>", "</s>"}
+	plain.Number = [2]string{"<n>", "</n>"}
+	plain.True = [2]string{"<t>", "</t>"}
+	plain.False = [2]string{}
+	plain.Null = [2]string{}
+	plain.Escape = [2]string{}
+	plain.Brackets = [2]string{}
+	assertEqual(t, `{<k>""</k>:<e>""</e>,<k>"a"</k>:<z>0</z>,<k>"b"</k>:<z>-0.0e5</z>,`+
+		`<k>"c"</k>:<f>false</f>,<k>"d"</k>:<n>0.1</n>,<k>"e"</k>:<s>"x"</s>,`+
+		`<k>"f"</k>:<t>true</t>}`, string(Color(json, &plain)))
+	var w bytes.Buffer
+	ColorReaderWriter(&w, iotest.OneByteReader(bytes.NewReader(json)), &plain)
+	assertEqual(t, string(Color(json, &plain)), w.String())
+	opts := *DefaultOptions
+	opts.Colorize = &plain
+	assertEqual(t, string(Color(Pretty(json), &plain)),
+		string(PrettyOptions(json, &opts)))
+}
+
+func TestKeyTree(t *testing.T) {
+	assertEqual(t, `{"a":{"b":"number"},"c":["number"]}`,
+		string(KeyTree([]byte(`{"a":{"b":1},"c":[2]}`))))
+	json := []byte(`{"z":[{"y":"s","x":null},true],"e":{},"d":[],"a":-1.5}`)
+	assertEqual(t, `{"a":"number","d":[],"e":{},`+
+		`"z":[{"x":"null","y":"string"},"boolean"]}`, string(KeyTree(json)))
+	assertEqual(t, string(KeyTree(json)),
+		string(KeyTree(Pretty([]byte(`{"a":2,"z":[{"x":null,"y":""},false],"d":[],"e":{}}`)))))
+	assertEqual(t, `"string"`, string(KeyTree([]byte(`"x"`))))
+}
+
+func TestSanitizeControls(t *testing.T) {
+	buf := Pretty([]byte("{\"a\x1b\":\"x\ty\\\"\x00\",\"b\":[1,\"\x7f\"]}"))
+	out := SanitizeControls(buf)
+	assertEqual(t, `{
+  "a\u001b": "x\u0009y\"\u0000",
+  "b": [1, "\u007f"]
+}
+`, string(out))
+	assertEqual(t, string(out), string(SanitizeControls(out)))
+	assertEqual(t, "\\u001b[1m{}", string(SanitizeControls([]byte("\x1b[1m{}"))))
+}
+
+func TestEnvStyle(t *testing.T) {
+	json := []byte(`{"name":"app","db":{"host":"localhost","port":5432,"opts":{}},` +
+		`"tags":["a b",["c"]],"debug":false,"path":"$HOME/x","note":"say \"hi\"\n",` +
+		`"empty":"","none":null,"my-key":[]}`)
+	assertEqual(t, `name=app
+db_host=localhost
+db_port=5432
+db_opts='{}'
+tags_0="a b"
+tags_1_0=c
+debug=false
+path="\$HOME/x"
+note="say \"hi\"\n"
+empty=""
+none=
+my_key='[]'
+`, string(EnvStyle(json, nil)))
+	opts := *DefaultOptions
+	opts.SortKeys = true
+	opts.UppercaseKeys = true
+	assertEqual(t, "A_B=1\nZ=2\n", string(EnvStyle([]byte(`{"z":2,"a":{"b":1}}`), &opts)))
+	assertEqual(t, "", string(EnvStyle([]byte(`"x"`), nil)))
+}
+
+func TestEscapeWhitespace(t *testing.T) {
+	style := *TerminalStyle
+	json := []byte("{\"a\tb\":\"1\n2\r\v\"}")
+	assertEqual(t, string(Color(json, TerminalStyle)), string(Color(json, &style)))
+	style.EscapeWhitespace = true
+	assertEqual(t, "\x1b[1m{\x1b[0m"+
+		"\x1b[1m\x1b[94m\"a\x1b[0m\x1b[35m\\t\x1b[0m\x1b[1m\x1b[94mb\"\x1b[0m"+
+		"\x1b[1m:\x1b[0m"+
+		"\x1b[32m\"1\x1b[0m\x1b[35m\\n\x1b[0m\x1b[32m2\x1b[0m\x1b[35m\\r\x1b[0m"+
+		"\x1b[32m\x1b[0m\x1b[35m\\u000b\x1b[0m\x1b[32m\"\x1b[0m"+
+		"\x1b[1m}\x1b[0m", string(Color(json, &style)))
+}
+
+func TestValueFormatter(t *testing.T) {
+	json := []byte(`{"items":[{"price":12.5,"name":"a"},{"price":3}],"prices":[1,2],"pairs":[["x",1]]}`)
+	var paths []string
+	opts := *DefaultOptions
+	opts.ValueFormatter = func(path string, raw []byte, kind TokenKind) ([]byte, bool) {
+		paths = append(paths, path)
+		if kind == TokenNumber && strings.HasPrefix(path, "items.") {
+			return []byte(`"$` + string(raw) + `"`), true
+		}
+		return nil, false
+	}
+	assertEqual(t, `{"items":[{"price":"$12.5","name":"a"},{"price":"$3"}],"prices":[1,2],"pairs":[["x",1]]}`,
+		string(Ugly(PrettyOptions(json, &opts))))
+	opts.FillArrays = true
+	opts.PairColumns = true
+	opts.Width = 1
+	paths = nil
+	PrettyOptions(json, &opts)
+	assertEqual(t, `[items.0.price items.0.name items.1.price prices.0 prices.1 pairs.0.0 pairs.0.0 pairs.0.1]`,
+		fmt.Sprint(paths))
+}
+
+func TestDedupKeys(t *testing.T) {
+	json := []byte(`{"b":1,"a":{"x":1,"x":2},"b":[3],"a":true}`)
+	opts := *DefaultOptions
+	opts.SortKeys = true
+	opts.DedupKeys = true
+	var tokens []string
+	opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+		tokens = append(tokens, string(json[srcStart:srcEnd]))
+	}
+	assertEqual(t, `{
+  "a": true,
+  "b": [3]
+}
+`, string(PrettyOptions(json, &opts)))
+	assertEqual(t, `[{"b":1,"a":{"x":1,"x":2},"b":[3],"a":true} "a" true "b" [3] 3]`,
+		fmt.Sprint(tokens))
+	opts.OnToken = nil
+	assertEqual(t, `{"a":{"x":2}}`, string(Ugly(PrettyOptions([]byte(`{"a":{"x":1,"x":2}}`), &opts))))
+	opts.SortKeys = false
+	assertEqual(t, `{"x":1,"x":2}`, string(Ugly(PrettyOptions([]byte(`{"x":1,"x":2}`), &opts))))
+}
+
+func TestColorSemantic(t *testing.T) {
+	red := &Style{String: [2]string{"<red>", "</red>"}, Number: [2]string{"<red>", "</red>"}}
+	rules := map[string]map[string]*Style{
+		"level": {"error": red, "5": red},
+	}
+	json := []byte(`{"level":"error","msg":"error","l":{"level":5},"a":["error"],"level":"info"}`)
+	want := string(Color(json, nil))
+	want = strings.Replace(want, "\x1b[32m\"error\"\x1b[0m", "<red>\"error\"</red>", 1)
+	want = strings.Replace(want, "\x1b[33m5\x1b[0m", "<red>5</red>", 1)
+	assertEqual(t, want, string(ColorSemantic(json, rules, nil)))
+	assertEqual(t, string(Color(json, nil)), string(ColorSemantic(json, nil, nil)))
+}
+
+func TestCompactArraysOnly(t *testing.T) {
+	json := []byte(`{"points":[1,2,3,4,5,6,7,8,9,10],"grid":[[1,2],["a",null]],` +
+		`"meta":{"x":1},"list":[{"y":[true]},2],"empty":{}}`)
+	expect := `{
+  "points": [1, 2, 3, 4, 5, 6, 7, 8, 9, 10],
+  "grid": [[1, 2], ["a", null]],
+  "meta": {
+    "x": 1
+  },
+  "list": [
+    {
+      "y": [true]
+    },
+    2
+  ],
+  "empty": {}
+}
+`
+	for _, width := range []int{0, 10, 80, 200} {
+		opts := *DefaultOptions
+		opts.Width = width
+		opts.PackLeafObjects = true
+		opts.CompactArraysOnly = true
+		assertEqual(t, expect, string(PrettyOptions(json, &opts)))
+		opts.Colorize = TerminalStyle
+		assertEqual(t, string(Color([]byte(expect), nil)), string(PrettyOptions(json, &opts)))
+	}
+	// the arrays with more than ItemsPerLine elements are not compacted,
+	// including the nested ones
+	opts := *DefaultOptions
+	opts.CompactArraysOnly = true
+	opts.ItemsPerLine = 2
+	assertEqual(t, `{
+  "a": [
+    [1, 2],
+    [
+      3, 4,
+      5
+    ]
+  ],
+  "b": {}
+}
+`, string(PrettyOptions([]byte(`{"a":[[1,2],[3,4,5]],"b":{}}`), &opts)))
+}
+
+func TestNeverExpandScalarArrays(t *testing.T) {
+	json := []byte(`{"a":[1,2,3,4,5,6,7,8],"b":[[1],2],"c":["xx","yy"]}`)
+	opts := *DefaultOptions
+	opts.Width = 10
+	opts.NeverExpandScalarArrays = true
+	assertEqual(t, `{
+  "a": [1, 2, 3, 4, 5, 6, 7, 8],
+  "b": [
+    [1],
+    2
+  ],
+  "c": ["xx", "yy"]
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.Width = 0
+	opts.MaxInlineArrayElements = 2
+	opts.Colorize = TerminalStyle
+	out := PrettyOptions(json, &opts)
+	opts.Colorize = nil
+	assertEqual(t, string(Color(PrettyOptions(json, &opts), nil)), string(out))
+	assertEqual(t, `{
+  "a": [
+    1,
+    2,
+    3,
+    4,
+    5,
+    6,
+    7,
+    8
+  ],
+  "b": [
+    [1],
+    2
+  ],
+  "c": ["xx", "yy"]
+}
+`, string(PrettyOptions(json, &opts)))
+}
+
+func TestBreakFunc(t *testing.T) {
+	json := []byte(`{"a":[1,2,3],"b":{"c":1,"d":[4]},"e":{"f":"g"},"h":[{"i":1}]}`)
+	var calls []string
+	opts := *DefaultOptions
+	opts.Width = 0
+	opts.BreakFunc = func(depth int, kind TokenKind, childCount int) bool {
+		calls = append(calls, fmt.Sprintf("%d:%d:%d", depth, kind, childCount))
+		return childCount > 1
+	}
+	assertEqual(t, `{
+  "a": [
+    1,
+    2,
+    3
+  ],
+  "b": {
+    "c": 1,
+    "d": [4]
+  },
+  "e": {"f": "g"},
+  "h": [
+    {"i": 1}
+  ]
+}
+`, string(PrettyOptions(json, &opts)))
+	assertEqual(t, `[0:6:4 1:7:3 1:6:2 2:7:1 1:6:1 1:7:1 2:6:1]`, fmt.Sprint(calls))
+}
+
+func TestMaxObjectKeys(t *testing.T) {
+	json := []byte(`{"d":1,"c":{"x":1,"y":2},"b":3,"a":4}`)
+	opts := *DefaultOptions
+	opts.MaxObjectKeys = 2
+	assertEqual(t, `{
+  "d": 1,
+  "c": {
+    "x": 1,
+    "y": 2
+  },
+  "… (2 more keys)"
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.SortKeys = true
+	opts.PackLeafObjects = true
+	assertEqual(t, `{
+  "a": 4,
+  "b": 3,
+  "… (2 more keys)"
+}
+`, string(PrettyOptions(json, &opts)))
+	opts.MaxObjectKeys = 1
+	assertEqual(t, `{
+  "a": 4,
+  "… (3 more keys)"
+}
+`, string(PrettyOptions(json, &opts)))
+	assertEqual(t, `{"a": 1, "… (1 more key)"}`, string(PrettyOptions([]byte(`{"b":2,"a":1}`), &opts)))
+	opts.SortKeys = false
+	assertEqual(t, `{"b": 2, "… (1 more key)"}`, string(PrettyOptions([]byte(`{"b":2,"a":1}`), &opts)))
+}
+
+func TestEqual(t *testing.T) {
+	a := []byte(`{"a":[1,"x",{"b":null}],"c":1.5}`)
+	b := []byte(` { "c" : 15e-1, "a" : [ 1.0, "\u0078", { "b": null } ] } `)
+	assertEqual(t, true, Equal(a, b))
+	assertEqual(t, true, Equal(a, a))
+	assertEqual(t, false, EqualOptions(a, b, true))
+	assertEqual(t, true, EqualOptions(a, []byte(`{"c":1.5,"a":[1,"x",{"b":null}]}`), true))
+	assertEqual(t, false, Equal(a, []byte(`{"a":[1,"x",{"b":null}],"c":1.6}`)))
+	assertEqual(t, false, Equal([]byte(`[1,2]`), []byte(`[2,1]`)))
+	assertEqual(t, false, Equal([]byte(`{"a":1}`), []byte(`{"a":1,"b":2}`)))
+	assertEqual(t, true, Equal([]byte(`{"a":1,"a":2}`), []byte(`{"a":2}`)))
+	assertEqual(t, true, Equal([]byte(`[]`), []byte(` [ ] `)))
+
+	// the numbers are compared exactly
+	for _, nums := range [][2]string{
+		{"1e20", "100000000000000000000"},
+		{"123456789012345678901234567890", "1.2345678901234567890123456789e29"},
+		{"0.001", "1E-3"},
+		{"1.50", "15e-1"},
+		{"-0", "0.0e5"},
+		{"1e400", "10e399"},
+	} {
+		assertEqual(t, true, Equal([]byte(nums[0]), []byte(nums[1])))
+		assertEqual(t, false, EqualOptions([]byte(nums[0]), []byte(nums[1]), true))
+	}
+	assertEqual(t, false, Equal([]byte("9007199254740993"), []byte("9007199254740992")))
+	assertEqual(t, false, Equal([]byte("1e400"), []byte("2e400")))
+	assertEqual(t, false, Equal([]byte("0.1"), []byte("-0.1")))
+}
+
+func TestChecksumComment(t *testing.T) {
+	json := []byte(`{"b":true,"a":[1,"x"]}`)
+	opts := *DefaultOptions
+	opts.ChecksumComment = true
+	out := PrettyOptions(json, &opts)
+	assertEqual(t, `{
+  "b": true,
+  "a": [1, "x"]
+}
+// sha256:90764eb5fcc9f8a703bec48739d5bde173aac3a96adb8214ab1d8c43504fd915
+`, string(out))
+	assertEqual(t, true, VerifyChecksum(out))
+	assertEqual(t, string(Ugly(json)), string(Ugly(Spec(out))))
+	// the checksum is of the document, not of its formatting
+	opts.SortKeys = true
+	opts.Prefix = "\t"
+	opts.Width = 0
+	sorted := PrettyOptions([]byte(` {"a":[1.0,"\u0078"],"b":true}`), &opts)
+	assertEqual(t, true, bytes.HasSuffix(sorted, out[bytes.Index(out, []byte("//")):]))
+	assertEqual(t, true, VerifyChecksum(sorted))
+	assertEqual(t, false, VerifyChecksum(bytes.Replace(out, []byte("true"), []byte("false"), 1)))
+	assertEqual(t, false, VerifyChecksum(json))
+	// single line output
+	assertEqual(t, true, VerifyChecksum(PrettyOptions([]byte(`[1,2]`), &opts)))
+	assertEqual(t, "[1, 2]\n// sha256:", string(PrettyOptions([]byte(`[1,2]`),
+		&Options{Width: 80, ChecksumComment: true}))[:17])
+}
+
+func TestBraceStyle(t *testing.T) {
+	json := []byte(`{"a":{"b":[1,2],"c":{}},"d":[{"e":1},[]],"f":1}`)
+	opts := *DefaultOptions
+	opts.BraceStyle = BraceAllman
+	expect := `{
+  "a":
+  {
+    "b":
+    [
+      1,
+      2
+    ],
+    "c": {}
+  },
+  "d":
+  [
+    {
+      "e": 1
+    },
+    []
+  ],
+  "f": 1
+}
+`
+	assertEqual(t, expect, string(PrettyOptions(json, &opts)))
+	// the single line paths are not used
+	opts.NeverExpandScalarArrays = true
+	opts.CompactArraysOnly = true
+	opts.PackLeafObjects = true
+	assertEqual(t, expect, string(PrettyOptions(json, &opts)))
+	opts.Colorize = TerminalStyle
+	assertEqual(t, string(Color([]byte(expect), nil)), string(PrettyOptions(json, &opts)))
+	assertEqual(t, string(Ugly(json)), string(Ugly([]byte(expect))))
+}
+
+func TestIndentObjectArray(t *testing.T) {
+	json := []byte(`{"a":[1,{"b":[2,3]}],"c":{"d":1}}`)
+	opts := *DefaultOptions
+	opts.Width = 0
+	opts.IndentArray = "\t"
+	assertEqual(t, "{\n"+
+		"  \"a\": [\n"+
+		"  \t1,\n"+
+		"  \t{\n"+
+		"  \t  \"b\": [\n"+
+		"  \t  \t2,\n"+
+		"  \t  \t3\n"+
+		"  \t  ]\n"+
+		"  \t}\n"+
+		"  ],\n"+
+		"  \"c\": {\n"+
+		"    \"d\": 1\n"+
+		"  }\n"+
+		"}\n", string(PrettyOptions(json, &opts)))
+	opts.IndentArray = ""
+	assertEqual(t, string(PrettyOptions(json, DiffOptions())), string(PrettyOptions(json, &opts)))
+	opts.IndentObject = "    "
+	opts.IndentArray = "  "
+	opts.FillArrays = true
+	opts.Width = 20
+	opts.Prefix = "> "
+	assertEqual(t, `> {
+>     "a": [
+>       1, 2, 3, 4,
+>       5, 6, 7
+>     ]
+> }
+`, string(PrettyOptions([]byte(`{"a":[1,2,3,4,5,6,7]}`), &opts)))
+}
+
+func TestPrettyWithSourceMap(t *testing.T) {
+	json := []byte(`{"b":[1,{"x":2}],"a":"s","c":{}}`)
+	opts := *DefaultOptions
+	opts.SortKeys = true
+	opts.Colorize = TerminalStyle
+	var calls int
+	opts.OnToken = func(kind TokenKind, srcStart, srcEnd, dstStart, dstEnd int) {
+		calls++
+	}
+	out, srcMap := PrettyWithSourceMap(json, &opts)
+	assertEqual(t, 11, calls)
+	opts.Colorize = nil
+	assertEqual(t, string(PrettyOptions(json, &opts)), string(out))
+	var tokens []string
+	for i, m := range srcMap {
+		if i > 0 && m.OutStart <= srcMap[i-1].OutStart {
+			t.Fatalf("out of order: %v", srcMap)
+		}
+		tok := string(out[m.OutStart : m.OutStart+m.Length])
+		assertEqual(t, tok, string(json[m.InStart:m.InStart+m.Length]))
+		tokens = append(tokens, tok)
+	}
+	assertEqual(t, `{ "a" "s" "b" [ 1 { "x" 2 } ] "c" { } }`, strings.Join(tokens, " "))
+	assertEqual(t, Mapping{OutStart: 4, InStart: 17, Length: 3}, srcMap[1])
+}
+
+func TestPrettyOptionsMapped(t *testing.T) {
+	json := []byte("{\"b\":[1,\n{\"x\":2}],\n// c\n\"a\":\"s\"}")
+	opts := *DefaultOptions
+	opts.PreserveComments = true
+	out, lines := PrettyOptionsMapped(json, &opts)
+	assertEqual(t, string(PrettyOptions(json, &opts)), string(out))
+	assertEqual(t, strings.Count(string(out), "\n"), len(lines))
+	assertEqual(t, []int{0, 1, 6, 9, 10, 15, 16, -1, 24, 31}, lines)
+}
+
+func TestPrettyMarshal(t *testing.T) {
+	v := struct {
+		B string         `json:"b"`
+		A map[string]int `json:"a"`
+	}{"<x/>", map[string]int{"z": 1, "y": 2}}
+	out, err := PrettyMarshal(v, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, `{
+  "b": "<x/>",
+  "a": {
+    "y": 2,
+    "z": 1
+  }
+}
+`, string(out))
+	opts := *DefaultOptions
+	opts.EscapeSlashes = true
+	opts.SortKeys = true
+	opts.Width = 100
+	out, _ = PrettyMarshal(v, &opts)
+	assertEqual(t, `{
+  "a": {
+    "y": 2,
+    "z": 1
+  },
+  "b": "\u003cx\/\u003e"
+}
+`, string(out))
+	if _, err := PrettyMarshal(func() {}, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package pretty
+
+// terminalWidth always returns zero on systems where the terminal size is
+// not detected.
+var terminalWidth = func() int { return 0 }
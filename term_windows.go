@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package pretty
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procGetConsoleScreenBufferInfo = syscall.NewLazyDLL("kernel32.dll").
+	NewProc("GetConsoleScreenBufferInfo")
+
+// terminalWidth returns the number of columns of the console attached to
+// stdout, or zero when stdout is not a console.
+var terminalWidth = func() int {
+	var info struct {
+		size, cursor             struct{ x, y int16 }
+		attrs                    uint16
+		left, top, right, bottom int16
+		max                      struct{ x, y int16 }
+	}
+	r, _, _ := procGetConsoleScreenBufferInfo.Call(os.Stdout.Fd(),
+		uintptr(unsafe.Pointer(&info)))
+	if r == 0 {
+		return 0
+	}
+	return int(info.right-info.left) + 1
+}